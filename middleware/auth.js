@@ -0,0 +1,110 @@
+const crypto = require('crypto');
+
+/**
+ * Scopes a client may narrow its JWT to when calling POST /token. A token
+ * without a scope claim carries the server token's full privileges.
+ */
+const KNOWN_SCOPES = ['read', 'write'];
+
+/**
+ * Parse the space-separated scope parameter of a /token request.
+ * Returns { scope } (undefined when none was asked for) or { error }.
+ */
+function parseRequestedScope(raw) {
+  if (raw === undefined || raw === null || raw === '') {
+    return { scope: undefined };
+  }
+  if (typeof raw !== 'string') {
+    return { error: 'scope must be a string' };
+  }
+  const scopes = [...new Set(raw.split(/\s+/).filter(Boolean))];
+  const unknown = scopes.filter((s) => !KNOWN_SCOPES.includes(s));
+  if (unknown.length > 0) {
+    return { error: `unknown scope: ${unknown.join(' ')}` };
+  }
+  return { scope: scopes.length > 0 ? scopes.join(' ') : undefined };
+}
+
+/**
+ * Requests that only read state. POST /token/introspect is a lookup even
+ * though it is a POST.
+ */
+function isReadOnlyRequest(req) {
+  return ['GET', 'HEAD', 'OPTIONS'].includes(req.method) ||
+    (req.method === 'POST' && req.path === '/token/introspect');
+}
+
+/**
+ * Whether a verified JWT payload may make this request: reads need the read
+ * or write scope, anything else needs write. Unscoped tokens may do anything.
+ */
+function scopeAllows(payload, req) {
+  if (!payload || typeof payload.scope !== 'string') {
+    return true;
+  }
+  const scopes = payload.scope.split(/\s+/);
+  if (scopes.includes('write')) {
+    return true;
+  }
+  return isReadOnlyRequest(req) && scopes.includes('read');
+}
+
+/**
+ * Requests signed with the JWT secret (read_config -sign) carry a timestamp,
+ * a nonce and an HMAC-SHA256 over "ts\nnonce\nMETHOD\npath\nsha256(body)".
+ * Timestamps outside the window are stale, and nonces are remembered for
+ * twice the window so a captured request cannot be replayed.
+ */
+const SIGNATURE_WINDOW_SECONDS = 300;
+
+/**
+ * Create a verifier with its own nonce memory. The returned function takes
+ * an Express request (rawBody kept by the JSON parser) and the shared secret
+ * and returns null when the signature is good, or the reason it is not.
+ */
+function createSignatureVerifier(windowSeconds = SIGNATURE_WINDOW_SECONDS) {
+  const seenNonces = new Map(); // nonce -> expiry (ms)
+  return function verifyRequestSignature(req, secret) {
+    const ts = req.get('X-Central-Mcp-Timestamp') || '';
+    const nonce = req.get('X-Central-Mcp-Nonce') || '';
+    const sig = req.get('X-Central-Mcp-Signature') || '';
+    if (!/^\d{1,12}$/.test(ts) || !/^[0-9a-f]{16,128}$/.test(nonce)) {
+      return 'Malformed signature headers';
+    }
+    if (Math.abs(Date.now() / 1000 - Number(ts)) > windowSeconds) {
+      return 'Stale timestamp';
+    }
+    const bodyHash = crypto
+      .createHash('sha256')
+      .update(req.rawBody || '')
+      .digest('hex');
+    const urlPath = req.originalUrl.split('?')[0];
+    const expected = crypto
+      .createHmac('sha256', secret)
+      .update([ts, nonce, req.method, urlPath, bodyHash].join('\n'))
+      .digest('hex');
+    const got = Buffer.from(sig);
+    const want = Buffer.from(expected);
+    if (got.length !== want.length || !crypto.timingSafeEqual(got, want)) {
+      return 'Bad signature';
+    }
+    const now = Date.now();
+    for (const [n, expires] of seenNonces) {
+      if (expires < now) seenNonces.delete(n);
+    }
+    if (seenNonces.has(nonce)) {
+      return 'Nonce already used';
+    }
+    seenNonces.set(nonce, now + 2 * windowSeconds * 1000);
+    return null;
+  };
+}
+
+module.exports = {
+  KNOWN_SCOPES,
+  SIGNATURE_WINDOW_SECONDS,
+  createSignatureVerifier,
+  parseRequestedScope,
+  isReadOnlyRequest,
+  scopeAllows
+};
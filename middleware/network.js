@@ -0,0 +1,85 @@
+const net = require('net');
+
+/**
+ * Keywords Express accepts in 'trust proxy' in place of an address.
+ */
+const PROXY_KEYWORDS = ['loopback', 'linklocal', 'uniquelocal'];
+
+/**
+ * Request headers browsers may send when CENTRAL_MCP_CORS_HEADERS is unset:
+ * the ones the API and its clients use.
+ */
+const DEFAULT_CORS_HEADERS = [
+  'Content-Type',
+  'Authorization',
+  'If-None-Match',
+  'X-Central-Mcp-Reason',
+  'X-Central-Mcp-Client-Tags',
+  'X-Central-Mcp-Timestamp',
+  'X-Central-Mcp-Nonce',
+  'X-Central-Mcp-Signature'
+];
+
+/**
+ * Split a comma-separated environment value into trimmed, non-empty entries.
+ */
+function parseList(raw) {
+  if (!raw) {
+    return [];
+  }
+  return raw.split(',').map((s) => s.trim()).filter(Boolean);
+}
+
+/**
+ * Parse CENTRAL_MCP_TRUSTED_PROXIES: IPs, CIDRs or Express keywords of the
+ * load balancers whose X-Forwarded-For header may be believed. Throws on an
+ * entry that is none of these so a typo fails at startup instead of silently
+ * trusting nothing.
+ */
+function parseTrustedProxies(raw) {
+  const entries = parseList(raw);
+  entries.forEach((entry) => {
+    if (PROXY_KEYWORDS.includes(entry)) {
+      return;
+    }
+    const [addr, bits, extra] = entry.split('/');
+    const family = net.isIP(addr);
+    const max = family === 6 ? 128 : 32;
+    const validBits = bits === undefined ||
+      (/^\d+$/.test(bits) && Number(bits) <= max);
+    if (!family || !validBits || extra !== undefined) {
+      throw new Error(`invalid trusted proxy: ${entry}`);
+    }
+  });
+  return entries;
+}
+
+/**
+ * Options for the cors middleware from CENTRAL_MCP_CORS_ORIGINS and
+ * CENTRAL_MCP_CORS_HEADERS. Without origins no CORS headers are sent, so only
+ * same-origin pages (the bundled dashboard) can call the API; "*" opts back
+ * into any origin. Credentials are never allowed: the API authenticates with
+ * bearer tokens, not cookies.
+ */
+function corsOptions(env) {
+  const origins = parseList(env.CENTRAL_MCP_CORS_ORIGINS);
+  const headers = parseList(env.CENTRAL_MCP_CORS_HEADERS);
+  let origin = false;
+  if (origins.includes('*')) {
+    origin = '*';
+  } else if (origins.length > 0) {
+    origin = origins;
+  }
+  return {
+    origin,
+    allowedHeaders: headers.length > 0 ? headers : DEFAULT_CORS_HEADERS,
+    credentials: false
+  };
+}
+
+module.exports = {
+  DEFAULT_CORS_HEADERS,
+  parseList,
+  parseTrustedProxies,
+  corsOptions
+};
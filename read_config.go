@@ -1,146 +1,4325 @@
 package main
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/fips140"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/tls"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
 	"encoding/json"
+	"encoding/pem"
+	"encoding/xml"
 	"errors"
 	"flag"
 	"fmt"
+	"hash"
 	"io"
+	"maps"
+	mrand "math/rand/v2"
+	"net"
 	"net/http"
+	"net/http/httptrace"
+	"net/url"
 	"os"
+	"os/exec"
+	"os/signal"
+	"os/user"
+	"path"
 	"path/filepath"
+	"reflect"
+	"regexp"
+	"runtime"
+	"slices"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"text/template"
 	"time"
+	"unicode/utf8"
 )
 
 type Config struct {
+	// SchemaVersion is the config layout version; older layouts are
+	// migrated on load (see migrateConfig) and by -migrate-config.
+	SchemaVersion         int               `json:"schemaVersion"`
 	CentralMcpServerUrl   string            `json:"centralMcpServerUrl"`
-	CentralMcpServerToken string            `json:"centralMcpServerToken"`
-	CentralMcpJwtSecret   string            `json:"centralMcpJwtSecret"`
-	Secrets               map[string]string `json:"secrets"`
+	CentralMcpServerToken Secret            `json:"centralMcpServerToken"`
+	CentralMcpJwtSecret   Secret            `json:"centralMcpJwtSecret"`
+	Secrets               map[string]Secret `json:"secrets"`
+	// Resolvers maps a name prefix ("legacy" for "legacy:db/main") to an
+	// external command that resolves secrets outside the central server.
+	Resolvers map[string][]string `json:"resolvers"`
+	// CacheTTL overrides the -cache-ttl duration for individual secrets.
+	CacheTTL map[string]string `json:"cacheTtl"`
+	Timeouts Timeouts          `json:"timeouts"`
+	// IPFamily forces "4" or "6"; empty dials dual-stack (happy eyeballs).
+	IPFamily string `json:"ipFamily"`
+	// FIPS restricts TLS to FIPS-approved versions, suites and curves and
+	// requires the Go FIPS 140 module to be active.
+	FIPS bool `json:"fips"`
+	// MaxResponseBytes caps every (decompressed) response body.
+	MaxResponseBytes int64 `json:"maxResponseBytes"`
+	// NameCase is the secret name case policy: "lower" or "" (preserve).
+	NameCase string `json:"nameCase"`
+	// NamePolicy is what happens to a requested name that breaks the naming
+	// rules: "warn" (the default) reads it as given, "strict" refuses it.
+	NamePolicy string `json:"namePolicy"`
+	// EnvMapping maps environment variable names to secret names for -exec.
+	EnvMapping map[string]string `json:"envMapping"`
+	// Overlays holds per-environment patches ("prod", "staging", ...) to the
+	// base settings; Overlay names the one to apply.
+	Overlays map[string]Overlay `json:"overlays"`
+	Overlay  string             `json:"overlay"`
+	// ScrubEnv lists extra env var patterns (path.Match globs) removed from
+	// the -exec child environment when -scrub-env is set.
+	ScrubEnv []string `json:"scrubEnv"`
+	// RequireReason makes -reason mandatory for secret reads.
+	RequireReason bool `json:"requireReason"`
+	// ClockSkewLeeway is how far local time may drift from the server (and
+	// from JWT iat/exp) before a warning is printed. Defaults to 1m.
+	ClockSkewLeeway string `json:"clockSkewLeeway"`
+	// ClientName identifies this client in the User-Agent and ClientTags
+	// ("service=checkout,pipeline=deploy-42") are sent with every request,
+	// so server audit logs can attribute reads.
+	ClientName string `json:"clientName"`
+	ClientTags string `json:"clientTags"`
+	// Sign, Scope and Reason are the -sign, -scope and -reason settings.
+	Sign   bool   `json:"sign"`
+	Scope  string `json:"scope"`
+	Reason string `json:"reason"`
+	// DefaultCacheTTL is the -cache-ttl duration for secrets without a
+	// cacheTtl entry; empty or "0" disables the cache.
+	DefaultCacheTTL string `json:"defaultCacheTtl"`
+	// CoreDumps leaves core dumps enabled; by default disableCoreDumps runs
+	// at startup.
+	CoreDumps bool `json:"coreDumps"`
+
+	// path of the config file that was loaded, if any
+	path string
+	// encrypted is set when the file on disk was age/SOPS encrypted
+	encrypted bool
+	// fileHasCredentials is set when the file itself (not the environment)
+	// holds tokens or secrets
+	fileHasCredentials bool
+	// sources records where each configOptions value came from
+	sources map[string]string
+	// fileValues and flagValues hold the configOptions values set in the
+	// loaded file and on the command line
+	fileValues map[string]string
+	flagValues map[string]string
+}
+
+// configOption describes one scalar setting. loadConfig resolves every
+// option the same way: command-line flag, then environment, then config
+// file, then default; -show and -explain report the result.
+type configOption struct {
+	key    string // name in the config file
+	env    string // environment override, if any
+	flag   string // command-line override, if any
+	def    string // effective default when unset
+	secret bool
+	get    func(*Config) string
+	set    func(*Config, string) error
+}
+
+func setString(field func(*Config) *string) func(*Config, string) error {
+	return func(c *Config, v string) error {
+		*field(c) = v
+		return nil
+	}
+}
+
+func setOneOf(field func(*Config) *string, allowed ...string) func(*Config, string) error {
+	return func(c *Config, v string) error {
+		if !slices.Contains(allowed, v) {
+			return fmt.Errorf("%q is not one of %s", v, strings.Join(allowed, ", "))
+		}
+		*field(c) = v
+		return nil
+	}
+}
+
+func setBool(field func(*Config) *bool) func(*Config, string) error {
+	return func(c *Config, v string) error {
+		b, err := strconv.ParseBool(v)
+		*field(c) = b
+		return err
+	}
+}
+
+func getBool(field func(*Config) *bool) func(*Config) string {
+	return func(c *Config) string {
+		if !*field(c) {
+			return ""
+		}
+		return "true"
+	}
+}
+
+var configOptions = []configOption{
+	{key: "centralMcpServerUrl", env: "CENTRAL_MCP_SERVER_URL",
+		get: func(c *Config) string { return c.CentralMcpServerUrl },
+		set: setString(func(c *Config) *string { return &c.CentralMcpServerUrl })},
+	{key: "centralMcpServerToken", env: "CENTRAL_MCP_SERVER_TOKEN", secret: true,
+		get: func(c *Config) string { return c.CentralMcpServerToken.Reveal() },
+		set: func(c *Config, v string) error { c.CentralMcpServerToken = Secret(v); return nil }},
+	{key: "centralMcpJwtSecret", env: "CENTRAL_MCP_JWT_SECRET", secret: true,
+		get: func(c *Config) string { return c.CentralMcpJwtSecret.Reveal() },
+		set: func(c *Config, v string) error { c.CentralMcpJwtSecret = Secret(v); return nil }},
+	{key: "timeouts.dial", env: "CENTRAL_MCP_DIAL_TIMEOUT", def: "5s",
+		get: func(c *Config) string { return c.Timeouts.Dial },
+		set: setString(func(c *Config) *string { return &c.Timeouts.Dial })},
+	{key: "timeouts.tlsHandshake", env: "CENTRAL_MCP_TLS_HANDSHAKE_TIMEOUT", def: "10s",
+		get: func(c *Config) string { return c.Timeouts.TLSHandshake },
+		set: setString(func(c *Config) *string { return &c.Timeouts.TLSHandshake })},
+	{key: "timeouts.responseHeader", env: "CENTRAL_MCP_RESPONSE_HEADER_TIMEOUT", def: "15s",
+		get: func(c *Config) string { return c.Timeouts.ResponseHeader },
+		set: setString(func(c *Config) *string { return &c.Timeouts.ResponseHeader })},
+	{key: "timeouts.total", env: "CENTRAL_MCP_TIMEOUT", def: "60s",
+		get: func(c *Config) string { return c.Timeouts.Total },
+		set: setString(func(c *Config) *string { return &c.Timeouts.Total })},
+	{key: "timeouts.resolver", env: "CENTRAL_MCP_RESOLVER_TIMEOUT", def: "30s",
+		get: func(c *Config) string { return c.Timeouts.Resolver },
+		set: setString(func(c *Config) *string { return &c.Timeouts.Resolver })},
+	{key: "ipFamily", env: "CENTRAL_MCP_IP_FAMILY", flag: "-4/-6",
+		get: func(c *Config) string { return c.IPFamily },
+		set: setString(func(c *Config) *string { return &c.IPFamily })},
+	{key: "fips", env: "CENTRAL_MCP_FIPS", flag: "-fips", def: "false",
+		get: getBool(func(c *Config) *bool { return &c.FIPS }),
+		set: setBool(func(c *Config) *bool { return &c.FIPS })},
+	{key: "maxResponseBytes", env: "CENTRAL_MCP_MAX_RESPONSE_BYTES", def: strconv.Itoa(defaultMaxResponseBytes),
+		get: func(c *Config) string {
+			if c.MaxResponseBytes == 0 {
+				return ""
+			}
+			return strconv.FormatInt(c.MaxResponseBytes, 10)
+		},
+		set: func(c *Config, v string) (err error) {
+			c.MaxResponseBytes, err = strconv.ParseInt(v, 10, 64)
+			return err
+		}},
+	{key: "clockSkewLeeway", env: "CENTRAL_MCP_CLOCK_SKEW_LEEWAY", def: "1m",
+		get: func(c *Config) string { return c.ClockSkewLeeway },
+		set: setString(func(c *Config) *string { return &c.ClockSkewLeeway })},
+	{key: "nameCase",
+		get: func(c *Config) string { return c.NameCase },
+		set: setOneOf(func(c *Config) *string { return &c.NameCase }, "lower")},
+	{key: "namePolicy", def: "warn",
+		get: func(c *Config) string { return c.NamePolicy },
+		set: setOneOf(func(c *Config) *string { return &c.NamePolicy }, "warn", "strict")},
+	{key: "clientName", env: "CENTRAL_MCP_CLIENT_NAME", flag: "-client-name",
+		get: func(c *Config) string { return c.ClientName },
+		set: setString(func(c *Config) *string { return &c.ClientName })},
+	{key: "clientTags", env: "CENTRAL_MCP_CLIENT_TAGS", flag: "-client-tags",
+		get: func(c *Config) string { return c.ClientTags },
+		set: setString(func(c *Config) *string { return &c.ClientTags })},
+	{key: "overlay", env: "CENTRAL_MCP_OVERLAY", flag: "-overlay",
+		get: func(c *Config) string { return c.Overlay },
+		set: setString(func(c *Config) *string { return &c.Overlay })},
+	{key: "requireReason", def: "false",
+		get: getBool(func(c *Config) *bool { return &c.RequireReason }),
+		set: setBool(func(c *Config) *bool { return &c.RequireReason })},
+	{key: "sign", env: "CENTRAL_MCP_SIGN", flag: "-sign", def: "false",
+		get: getBool(func(c *Config) *bool { return &c.Sign }),
+		set: setBool(func(c *Config) *bool { return &c.Sign })},
+	{key: "scope", env: "CENTRAL_MCP_SCOPE", flag: "-scope",
+		get: func(c *Config) string { return c.Scope },
+		set: setString(func(c *Config) *string { return &c.Scope })},
+	{key: "reason", env: "CENTRAL_MCP_REASON", flag: "-reason",
+		get: func(c *Config) string { return c.Reason },
+		set: setString(func(c *Config) *string { return &c.Reason })},
+	{key: "defaultCacheTtl", env: "CENTRAL_MCP_CACHE_TTL", flag: "-cache-ttl", def: "0s",
+		get: func(c *Config) string { return c.DefaultCacheTTL },
+		set: setString(func(c *Config) *string { return &c.DefaultCacheTTL })},
+	{key: "coreDumps", env: "CENTRAL_MCP_CORE_DUMPS", def: "false",
+		get: getBool(func(c *Config) *bool { return &c.CoreDumps }),
+		set: setBool(func(c *Config) *bool { return &c.CoreDumps })},
+}
+
+// resolveOptions applies configOptions to c from flags (keyed by option
+// key), the environment and file (nil when no file was loaded), recording
+// the winning source of each.
+func (c *Config) resolveOptions(flags map[string]string, file *Config) error {
+	c.sources = map[string]string{}
+	c.fileValues = map[string]string{}
+	c.flagValues = flags
+	for _, o := range configOptions {
+		var v, src string
+		if file != nil {
+			c.fileValues[o.key] = o.get(file)
+		}
+		switch {
+		case flags[o.key] != "":
+			v, src = flags[o.key], "flag "+o.flag
+		case o.env != "" && os.Getenv(o.env) != "":
+			v, src = os.Getenv(o.env), "env "+o.env
+		case c.fileValues[o.key] != "":
+			v, src = c.fileValues[o.key], "file "+c.path
+		default:
+			src = "default"
+		}
+		if v != "" {
+			if err := o.set(c, v); err != nil {
+				return fmt.Errorf("invalid %s (%s): %w", o.key, src, err)
+			}
+		}
+		c.sources[o.key] = src
+	}
+	return nil
+}
+
+// explainOption reports, for one setting, every source that could supply it
+// in precedence order, which one won, and why the others were not used.
+func explainOption(w io.Writer, cfg *Config, key string) error {
+	var opt *configOption
+	keys := make([]string, 0, len(configOptions))
+	for i := range configOptions {
+		keys = append(keys, configOptions[i].key)
+		if configOptions[i].key == key {
+			opt = &configOptions[i]
+		}
+	}
+	if opt == nil {
+		return fmt.Errorf("unknown setting %q (want one of: %s)", key, strings.Join(keys, ", "))
+	}
+	show := func(v string) string {
+		if opt.secret {
+			v = mask(v)
+		}
+		return strconv.Quote(v)
+	}
+	won := cfg.sources[key]
+	effective := opt.get(cfg)
+	if effective == "" {
+		effective = opt.def
+	}
+	fmt.Fprintf(w, "%s = %s\n  from %s\n\nsources, highest precedence first:\n", key, show(effective), won)
+
+	if opt.flag != "" {
+		if v := cfg.flagValues[key]; v != "" {
+			fmt.Fprintf(w, "  flag %s: %s (used)\n", opt.flag, show(v))
+		} else {
+			fmt.Fprintf(w, "  flag %s: not given\n", opt.flag)
+		}
+	}
+
+	if opt.env != "" {
+		v, set := os.LookupEnv(opt.env)
+		switch {
+		case !set:
+			fmt.Fprintf(w, "  env %s: not set\n", opt.env)
+		case v == "":
+			fmt.Fprintf(w, "  env %s: empty (ignored)\n", opt.env)
+		case won == "env "+opt.env:
+			fmt.Fprintf(w, "  env %s: %s (used)\n", opt.env, show(v))
+		default:
+			fmt.Fprintf(w, "  env %s: %s (ignored: overridden by %s)\n", opt.env, show(v), won)
+		}
+	}
+	for _, p := range configCandidates() {
+		switch {
+		case !fileExists(p):
+			fmt.Fprintf(w, "  file %s: not present\n", p)
+		case p == cfg.path:
+			v := cfg.fileValues[key]
+			switch {
+			case v == "":
+				fmt.Fprintf(w, "  file %s: not set (loaded)\n", p)
+			case won == "file "+p:
+				fmt.Fprintf(w, "  file %s: %s (used)\n", p, show(v))
+			default:
+				fmt.Fprintf(w, "  file %s: %s (ignored: overridden by %s)\n", p, show(v), won)
+			}
+		default:
+			// only the first existing candidate is loaded
+			fmt.Fprintf(w, "  file %s: not read (%s was found first)\n", p, cfg.path)
+		}
+	}
+	if won == "default" {
+		fmt.Fprintf(w, "  default: %s (used)\n", show(opt.def))
+	} else {
+		fmt.Fprintf(w, "  default: %s\n", show(opt.def))
+	}
+	return nil
+}
+
+// shownValue is one entry of -show -format json|yaml.
+type shownValue struct {
+	Value  string `json:"value"`
+	Source string `json:"source"`
+}
+
+// showConfig prints the resolved configuration with secrets masked, either
+// as the historical text summary or as JSON/YAML with each value's source.
+func showConfig(w io.Writer, cfg *Config, format string) error {
+	switch format {
+	case "", "text":
+		fmt.Fprintln(w, "resolved config:")
+		fmt.Fprintln(w, "  serverUrl:", cfg.CentralMcpServerUrl)
+		fmt.Fprintln(w, "  serverToken:", mask(cfg.CentralMcpServerToken.Reveal()))
+		fmt.Fprintln(w, "  jwtSecret:", mask(cfg.CentralMcpJwtSecret.Reveal()))
+		return nil
+	case "json", "yaml":
+	default:
+		return fmt.Errorf("unknown -show format %q (want text, json or yaml)", format)
+	}
+	values := map[string]shownValue{}
+	for _, o := range configOptions {
+		v := o.get(cfg)
+		switch {
+		case o.secret:
+			v = mask(v)
+		case v == "":
+			v = o.def
+		}
+		values[o.key] = shownValue{Value: v, Source: cfg.sources[o.key]}
+	}
+	if format == "json" {
+		b, err := json.MarshalIndent(struct {
+			ConfigFile string                `json:"configFile"`
+			Values     map[string]shownValue `json:"values"`
+		}{cfg.path, values}, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintln(w, string(b))
+		return err
+	}
+	// strconv.Quote output is a valid YAML double-quoted scalar
+	fmt.Fprintf(w, "configFile: %s\nvalues:\n", strconv.Quote(cfg.path))
+	for _, o := range configOptions {
+		v := values[o.key]
+		fmt.Fprintf(w, "  %s:\n    value: %s\n    source: %s\n", o.key, strconv.Quote(v.Value), strconv.Quote(v.Source))
+	}
+	return nil
+}
+
+// Overlay patches the base config for one environment.
+type Overlay struct {
+	// EnvMapping entries add to or replace the base envMapping; an empty
+	// secret name removes the variable.
+	EnvMapping map[string]string `json:"envMapping"`
+}
+
+// applyOverlay merges the selected overlay into the base settings.
+func (c *Config) applyOverlay() error {
+	if c.Overlay == "" {
+		return nil
+	}
+	ov, ok := c.Overlays[c.Overlay]
+	if !ok {
+		return fmt.Errorf("unknown overlay %q (%s)", c.Overlay, c.sources["overlay"])
+	}
+	mapping := make(map[string]string, len(c.EnvMapping)+len(ov.EnvMapping))
+	for k, v := range c.EnvMapping {
+		mapping[k] = v
+	}
+	for k, v := range ov.EnvMapping {
+		if v == "" {
+			delete(mapping, k)
+		} else {
+			mapping[k] = v
+		}
+	}
+	c.EnvMapping = mapping
+	return nil
+}
+
+// Timeouts configures the HTTP client per phase. Values are Go durations
+// ("10s", "1m"); empty means the default.
+type Timeouts struct {
+	Dial           string `json:"dial"`
+	TLSHandshake   string `json:"tlsHandshake"`
+	ResponseHeader string `json:"responseHeader"`
+	Total          string `json:"total"`
+	// Resolver bounds each external resolver plugin run.
+	Resolver string `json:"resolver"`
+}
+
+// Secret holds a credential. It formats as "****" under every fmt verb so a
+// config struct or error that embeds it cannot leak the value; call Reveal at
+// the few places the raw value is actually needed.
+type Secret string
+
+func (s Secret) Reveal() string { return string(s) }
+
+func (s Secret) String() string {
+	if s == "" {
+		return ""
+	}
+	return "****"
+}
+
+func (s Secret) GoString() string { return `"` + s.String() + `"` }
+
+func (s Secret) Format(f fmt.State, _ rune) { io.WriteString(f, s.String()) }
+
+// redactor remembers every credential and secret value the process has seen
+// so diagnostics can be scrubbed centrally before they are written.
+type redactor struct {
+	mu     sync.Mutex
+	values []string
+}
+
+// knownSecrets collects values to redact from everything written to stderr.
+var knownSecrets = &redactor{}
+
+// stderr is where the tool's own diagnostics go; it redacts known secrets.
+var stderr io.Writer = &redactingWriter{w: os.Stderr, r: knownSecrets}
+
+// add registers a value; very short values are skipped since masking them
+// would mangle ordinary text.
+func (r *redactor) add(v string) {
+	if len(v) < 4 {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, have := range r.values {
+		if have == v {
+			return
+		}
+	}
+	r.values = append(r.values, v)
+	// replace longer values first so a value containing another is fully masked
+	sort.Slice(r.values, func(i, j int) bool { return len(r.values[i]) > len(r.values[j]) })
+}
+
+func (r *redactor) redact(s string) string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, v := range r.values {
+		s = strings.ReplaceAll(s, v, "****")
+	}
+	return s
+}
+
+type redactingWriter struct {
+	w io.Writer
+	r *redactor
+}
+
+func (w *redactingWriter) Write(p []byte) (int, error) {
+	if _, err := io.WriteString(w.w, w.r.redact(string(p))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// currentSchemaVersion is the config layout this client writes and reads
+// natively.
+const currentSchemaVersion = 1
+
+// configMigrations[v] upgrades a raw version-v config document to v+1.
+// Renaming or restructuring a field means adding a step here, so existing
+// installs keep loading.
+var configMigrations = []func(doc map[string]any) error{
+	// 0 -> 1: unversioned files already use the version 1 layout
+	func(doc map[string]any) error { return nil },
+}
+
+// migrateConfig upgrades a raw config document to currentSchemaVersion,
+// returning it unchanged when it is already current, along with the version
+// it started at. Documents from a newer client are rejected rather than
+// silently misread.
+func migrateConfig(b []byte) ([]byte, int, error) {
+	return runMigrations(b, configMigrations)
+}
+
+// runMigrations applies steps to b; the version after the last step,
+// len(steps), is the current one.
+func runMigrations(b []byte, steps []func(doc map[string]any) error) ([]byte, int, error) {
+	current := len(steps)
+	// the limits must hold for the operator's file itself, not just for the
+	// re-marshalled document decodeJSON sees after a migration
+	if err := checkJSONLimits(b); err != nil {
+		return nil, 0, err
+	}
+	var doc map[string]any
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	if err := dec.Decode(&doc); err != nil {
+		return nil, 0, err
+	}
+	from := 0
+	if v, ok := doc["schemaVersion"]; ok {
+		n, ok := v.(json.Number)
+		i, err := n.Int64()
+		if !ok || err != nil || i < 0 {
+			return nil, 0, fmt.Errorf("invalid schemaVersion %v", v)
+		}
+		from = int(i)
+	}
+	if from > current {
+		return nil, from, fmt.Errorf("schemaVersion %d is newer than this client supports (%d); upgrade the client", from, current)
+	}
+	if from == current {
+		return b, from, nil
+	}
+	for v := from; v < current; v++ {
+		if err := steps[v](doc); err != nil {
+			return nil, from, fmt.Errorf("migrating schemaVersion %d: %w", v, err)
+		}
+	}
+	doc["schemaVersion"] = current
+	out, err := json.MarshalIndent(doc, "", "    ")
+	return out, from, err
+}
+
+// migrateConfigFile rewrites the loaded config file in the current layout.
+// Encrypted files are left alone since re-encrypting needs the operator's
+// keys and recipients.
+func migrateConfigFile(cfg *Config) (from int, err error) {
+	if cfg.path == "" {
+		return 0, errors.New("no config file found")
+	}
+	if cfg.encrypted {
+		return 0, fmt.Errorf("%s is encrypted; decrypt it, run -migrate-config and re-encrypt", cfg.path)
+	}
+	b, err := os.ReadFile(cfg.path)
+	if err != nil {
+		return 0, err
+	}
+	defer clear(b)
+	out, from, err := migrateConfig(b)
+	if err != nil || from == currentSchemaVersion {
+		return from, err
+	}
+	defer clear(out)
+	st, err := os.Stat(cfg.path)
+	if err != nil {
+		return from, err
+	}
+	return from, writeFileAtomic(cfg.path, append(out, '\n'), st.Mode().Perm())
+}
+
+func fileExists(p string) bool {
+	_, err := os.Stat(p)
+	return err == nil
+}
+
+// loadConfig reads the first config file found and resolves every setting
+// with flag > env > file > default precedence. flags maps configOptions keys
+// to values given on the command line.
+func loadConfig(flags map[string]string) (*Config, error) {
+	cfg := &Config{}
+	var fcfg *Config
+	for _, p := range configCandidates() {
+		if !fileExists(p) {
+			continue
+		}
+		b, err := os.ReadFile(p)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", p, err)
+		}
+		b, encrypted, err := decryptConfig(p, b)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decrypt %s: %w", p, err)
+		}
+		migrated, _, err := migrateConfig(b)
+		if err != nil {
+			clear(b)
+			return nil, fmt.Errorf("failed to parse %s: %w", p, err)
+		}
+		fcfg = &Config{}
+		err = decodeJSON(migrated, fcfg)
+		// don't leave raw tokens in heap buffers longer than needed
+		clear(b)
+		clear(migrated)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %w", p, err)
+		}
+		cfg.Secrets = fcfg.Secrets
+		cfg.EnvMapping = fcfg.EnvMapping
+		cfg.Overlays = fcfg.Overlays
+		cfg.ScrubEnv = fcfg.ScrubEnv
+		cfg.Resolvers = fcfg.Resolvers
+		cfg.CacheTTL = fcfg.CacheTTL
+		cfg.path = p
+		cfg.encrypted = encrypted
+		cfg.fileHasCredentials = fcfg.hasCredentials()
+		break
+	}
+	if err := cfg.resolveOptions(flags, fcfg); err != nil {
+		return nil, err
+	}
+	if err := cfg.applyOverlay(); err != nil {
+		return nil, err
+	}
+	knownSecrets.add(cfg.CentralMcpServerToken.Reveal())
+	knownSecrets.add(cfg.CentralMcpJwtSecret.Reveal())
+	return cfg, nil
+}
+
+// decryptConfig detects age- or SOPS-encrypted config files and decrypts them
+// with the corresponding CLI, so plaintext tokens never need to sit on disk.
+// SOPS finds its keys itself (SOPS_AGE_KEY_FILE, KMS, ...); for age the
+// identity file is taken from CENTRAL_MCP_AGE_IDENTITY.
+func decryptConfig(p string, b []byte) ([]byte, bool, error) {
+	trimmed := bytes.TrimSpace(b)
+	if bytes.HasPrefix(trimmed, []byte("age-encryption.org/")) || bytes.HasPrefix(trimmed, []byte("-----BEGIN AGE ENCRYPTED FILE-----")) {
+		id := os.Getenv("CENTRAL_MCP_AGE_IDENTITY")
+		if id == "" {
+			return nil, true, errors.New("config is age-encrypted but CENTRAL_MCP_AGE_IDENTITY is not set")
+		}
+		out, err := runDecrypter("age", "--decrypt", "-i", id, p)
+		return out, true, err
+	}
+	var probe struct {
+		Sops json.RawMessage `json:"sops"`
+	}
+	if decodeJSON(b, &probe) == nil && len(probe.Sops) > 0 {
+		out, err := runDecrypter("sops", "--decrypt", "--input-type", "json", "--output-type", "json", p)
+		return out, true, err
+	}
+	return b, false, nil
+}
+
+func runDecrypter(name string, args ...string) ([]byte, error) {
+	var stderr bytes.Buffer
+	cmd := exec.Command(name, args...)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, fmt.Errorf("%s: %w: %s", name, err, msg)
+		}
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	return out, nil
+}
+
+// configCandidates lists config file locations in lookup order (prefer C:\
+// if present to match server behavior, then the per-user config dir).
+func configCandidates() []string {
+	candidates := []string{`C:\central-mcp-config.json`}
+	if p := userConfigPath(); p != "" {
+		candidates = append(candidates, p)
+	}
+	return append(candidates, "central-mcp-config.json")
+}
+
+func userConfigPath() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "central-mcp", "config.json")
+}
+
+// hasCredentials reports whether the config holds anything worth protecting.
+func (c *Config) hasCredentials() bool {
+	return c.CentralMcpServerToken != "" || c.CentralMcpJwtSecret != "" || len(c.Secrets) > 0
+}
+
+// disableCoreDumps keeps fetched secrets out of crash dumps. On Linux it
+// clears /proc/self/coredump_filter so a dump carries no memory mappings.
+// RLIMIT_CORE cannot be lowered from here because syscall.Setrlimit does not
+// exist on Windows. Go itself only dumps core with GOTRACEBACK=crash, so
+// that setting is warned about on every platform.
+func disableCoreDumps() {
+	if runtime.GOOS == "linux" {
+		if err := os.WriteFile("/proc/self/coredump_filter", []byte("0"), 0); err != nil {
+			fmt.Fprintln(stderr, "warning: failed to disable core dumps:", err)
+		}
+	}
+	if tb := os.Getenv("GOTRACEBACK"); tb == "crash" || tb == "wer" {
+		fmt.Fprintf(stderr, "warning: GOTRACEBACK=%s lets a crash dump secrets to disk; set coreDumps to silence this\n", tb)
+	}
+}
+
+// checkConfigPermissions refuses a config file that itself contains tokens or
+// secrets when it is owned by another user, writable by group or others, or
+// world-readable, and warns about group-readable ones. Windows ACLs are not
+// inspected; a file in the C:\ root is only warned about. Encrypted files are
+// exempt.
+func checkConfigPermissions(cfg *Config) error {
+	if cfg.path == "" || cfg.encrypted || !cfg.fileHasCredentials {
+		return nil
+	}
+	if runtime.GOOS == "windows" {
+		if filepath.Dir(cfg.path) == `C:\` {
+			fmt.Fprintf(stderr, "warning: %s is in the C:\\ root and may be readable by other users; run with -harden-config to move it\n", cfg.path)
+		}
+		return nil
+	}
+	info, err := os.Stat(cfg.path)
+	if err != nil {
+		return err
+	}
+	if uid, ok := fileOwner(info); ok && int(uid) != os.Geteuid() {
+		return fmt.Errorf("%s is owned by uid %d, not the current user (%d), and contains credentials; pass -allow-insecure-config to use it anyway", cfg.path, uid, os.Geteuid())
+	}
+	perm := info.Mode().Perm()
+	if perm&0o022 != 0 {
+		return fmt.Errorf("%s is writable by other users (%04o) and contains credentials; run with -harden-config or pass -allow-insecure-config", cfg.path, perm)
+	}
+	if perm&0o004 != 0 {
+		return fmt.Errorf("%s is world-readable (%04o) and contains credentials; run with -harden-config or pass -allow-insecure-config", cfg.path, perm)
+	}
+	if perm&0o040 != 0 {
+		fmt.Fprintf(stderr, "warning: %s is group-readable (%04o); consider -harden-config\n", cfg.path, perm)
+	}
+	return nil
+}
+
+// fileOwner returns the owning uid from a Unix *syscall.Stat_t. It goes
+// through reflection because Stat_t does not exist on Windows, where ok is
+// always false.
+func fileOwner(info os.FileInfo) (uid uint32, ok bool) {
+	v := reflect.ValueOf(info.Sys())
+	if v.Kind() == reflect.Pointer {
+		v = v.Elem()
+	}
+	if v.Kind() != reflect.Struct {
+		return 0, false
+	}
+	f := v.FieldByName("Uid")
+	if !f.IsValid() || !f.CanUint() {
+		return 0, false
+	}
+	return uint32(f.Uint()), true
+}
+
+// hardenConfig restricts the loaded config file to its owner and moves it out
+// of the C:\ root into the per-user config dir. It returns the final path. On
+// Windows os.Chmod only toggles the read-only attribute, so the move is the
+// only hardening done there; the file's ACL is left as it is.
+func hardenConfig(cfg *Config) (string, error) {
+	if cfg.path == "" {
+		return "", errors.New("no config file found")
+	}
+	p := cfg.path
+	if filepath.Dir(p) == `C:\` {
+		dst := userConfigPath()
+		if dst == "" {
+			return "", errors.New("cannot determine user config directory")
+		}
+		if fileExists(dst) {
+			return "", fmt.Errorf("%s already exists; remove one of the two files first", dst)
+		}
+		if err := os.MkdirAll(filepath.Dir(dst), 0o700); err != nil {
+			return "", err
+		}
+		if err := os.Rename(p, dst); err != nil {
+			return "", fmt.Errorf("failed to move %s: %w", p, err)
+		}
+		p = dst
+	}
+	if err := os.Chmod(p, 0o600); err != nil {
+		return "", err
+	}
+	return p, nil
+}
+
+// apiBase returns the HTTP base URL for requests. unix:// and npipe:// server
+// URLs are dialed by localSocket, so requests just need a placeholder host.
+func apiBase(serverURL string) string {
+	if strings.HasPrefix(serverURL, "unix://") || strings.HasPrefix(serverURL, "npipe://") {
+		return "http://localhost"
+	}
+	return strings.TrimRight(serverURL, "/")
+}
+
+// localSocket returns a dialer for unix:///path/to.sock and (on Windows)
+// npipe:////./pipe/name server URLs, or nil for regular http(s) URLs.
+func localSocket(serverURL string) (func(context.Context, string, string) (net.Conn, error), error) {
+	switch {
+	case strings.HasPrefix(serverURL, "unix://"):
+		p := strings.TrimPrefix(serverURL, "unix://")
+		if p == "" {
+			return nil, errors.New("unix:// server URL has no socket path")
+		}
+		var d net.Dialer
+		return func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return d.DialContext(ctx, "unix", p)
+		}, nil
+	case strings.HasPrefix(serverURL, "npipe://"):
+		if runtime.GOOS != "windows" {
+			return nil, errors.New("npipe:// server URLs are only supported on Windows")
+		}
+		p := strings.ReplaceAll(strings.TrimPrefix(serverURL, "npipe://"), "/", `\`)
+		return func(ctx context.Context, _, _ string) (net.Conn, error) {
+			for {
+				f, err := os.OpenFile(p, os.O_RDWR|fileFlagOverlapped, 0)
+				if err == nil {
+					return pipeConn{f}, nil
+				}
+				if !errors.Is(err, errPipeBusy) {
+					return nil, err
+				}
+				select {
+				case <-ctx.Done():
+					return nil, ctx.Err()
+				case <-time.After(10 * time.Millisecond):
+				}
+			}
+		}, nil
+	}
+	return nil, nil
+}
+
+// fileFlagOverlapped is syscall.FILE_FLAG_OVERLAPPED, which only exists on
+// Windows; os.OpenFile passes it on to CreateFile. An overlapped pipe handle
+// is served by the runtime's I/O completion port, so reads do not pin a
+// thread and deadlines work, letting the HTTP transport time out and cancel
+// requests. A synchronous handle would block both.
+const fileFlagOverlapped = 0x40000000
+
+// errPipeBusy is ERROR_PIPE_BUSY: every instance of the pipe is connected.
+const errPipeBusy = syscall.Errno(231)
+
+// pipeConn adapts an opened Windows named pipe to net.Conn.
+type pipeConn struct{ *os.File }
+
+func (c pipeConn) LocalAddr() net.Addr  { return pipeAddr(c.Name()) }
+func (c pipeConn) RemoteAddr() net.Addr { return pipeAddr(c.Name()) }
+
+type pipeAddr string
+
+func (a pipeAddr) Network() string { return "npipe" }
+func (a pipeAddr) String() string  { return string(a) }
+
+func parseTimeout(name, v string, def time.Duration) (time.Duration, error) {
+	if v == "" {
+		return def, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s timeout %q: %w", name, v, err)
+	}
+	return d, nil
+}
+
+// newHTTPClient builds the client shared by all requests, with separate dial,
+// TLS handshake, response header and total timeouts.
+func newHTTPClient(cfg *Config) (*http.Client, error) {
+	dial, err := parseTimeout("dial", cfg.Timeouts.Dial, 5*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	tlsHandshake, err := parseTimeout("tlsHandshake", cfg.Timeouts.TLSHandshake, 10*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	responseHeader, err := parseTimeout("responseHeader", cfg.Timeouts.ResponseHeader, 15*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	total, err := parseTimeout("total", cfg.Timeouts.Total, 60*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	// net.Dialer races IPv6 and IPv4 (RFC 6555) for "tcp"; pin the family
+	// only when asked to, e.g. on IPv6-only runners with broken A records.
+	var network string
+	switch cfg.IPFamily {
+	case "":
+	case "4":
+		network = "tcp4"
+	case "6":
+		network = "tcp6"
+	default:
+		return nil, fmt.Errorf("invalid ipFamily %q (want 4 or 6)", cfg.IPFamily)
+	}
+	dialer := &net.Dialer{Timeout: dial, KeepAlive: 30 * time.Second}
+	dialContext := dialer.DialContext
+	if network != "" {
+		dialContext = func(ctx context.Context, _, addr string) (net.Conn, error) {
+			return dialer.DialContext(ctx, network, addr)
+		}
+	}
+	proxy := http.ProxyFromEnvironment
+	if local, err := localSocket(cfg.CentralMcpServerUrl); err != nil {
+		return nil, err
+	} else if local != nil {
+		dialContext = local
+		proxy = nil
+	}
+	var tlsConfig *tls.Config
+	if cfg.FIPS {
+		if tlsConfig, err = fipsTLSConfig(); err != nil {
+			return nil, err
+		}
+	}
+	transport := &http.Transport{
+		TLSClientConfig:       tlsConfig,
+		Proxy:                 proxy,
+		DialContext:           dialContext,
+		TLSHandshakeTimeout:   tlsHandshake,
+		ResponseHeaderTimeout: responseHeader,
+		ForceAttemptHTTP2:     true,
+		// gzip is handled by limitTransport so the limit applies after inflating
+		DisableCompression: true,
+	}
+	max := cfg.MaxResponseBytes
+	if max <= 0 {
+		max = defaultMaxResponseBytes
+	}
+	leeway, err := cfg.leeway()
+	if err != nil {
+		return nil, err
+	}
+	var base http.RoundTripper = transport
+	if p := os.Getenv("CENTRAL_MCP_CASSETTE"); p != "" {
+		if base, err = newCassette(p, os.Getenv("CENTRAL_MCP_CASSETTE_MODE"), os.Getenv("CENTRAL_MCP_CASSETTE_KEY"), transport); err != nil {
+			return nil, err
+		}
+	}
+	if v := os.Getenv("CENTRAL_MCP_FAULT"); v != "" {
+		if base, err = newFaultTransport(v, base); err != nil {
+			return nil, err
+		}
+	}
+	tags, err := parseClientTags(cfg.ClientTags)
+	if err != nil {
+		return nil, err
+	}
+	base = &identityTransport{base: base, userAgent: userAgent(cfg.ClientName), tags: tags}
+	rt := &clockTransport{base: &limitTransport{base: base, max: max}, leeway: leeway}
+	return &http.Client{Transport: rt, Timeout: total}, nil
+}
+
+// userAgent names the client, plus the configured client name if any.
+func userAgent(name string) string {
+	if name == "" {
+		return "central-mcp-client"
+	}
+	return "central-mcp-client (" + name + ")"
+}
+
+// parseClientTags validates "key=value,key=value" tags and returns them in
+// canonical sorted form for the X-Central-Mcp-Client-Tags header.
+func parseClientTags(spec string) (string, error) {
+	if spec == "" {
+		return "", nil
+	}
+	var tags []string
+	for _, t := range strings.Split(spec, ",") {
+		k, v, ok := strings.Cut(strings.TrimSpace(t), "=")
+		if !ok || k == "" || strings.ContainsAny(k+v, "\r\n") {
+			return "", fmt.Errorf("invalid client tag %q (want key=value)", t)
+		}
+		tags = append(tags, k+"="+v)
+	}
+	sort.Strings(tags)
+	return strings.Join(tags, ","), nil
+}
+
+// identityTransport sets the User-Agent and client tags on every request,
+// including /token and /health.
+type identityTransport struct {
+	base      http.RoundTripper
+	userAgent string
+	tags      string
+}
+
+func (t *identityTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.Header.Set("User-Agent", t.userAgent)
+	if t.tags != "" {
+		req.Header.Set("X-Central-Mcp-Client-Tags", t.tags)
+	}
+	return t.base.RoundTrip(req)
+}
+
+// faultTransport injects latency and failures for resilience testing. It is
+// configured from CENTRAL_MCP_FAULT, e.g. "latency:500ms,error-rate:0.2":
+// every request is delayed by latency, and the given fraction fails with a
+// transport error before reaching the server.
+type faultTransport struct {
+	base      http.RoundTripper
+	latency   time.Duration
+	errorRate float64
+}
+
+func newFaultTransport(spec string, base http.RoundTripper) (*faultTransport, error) {
+	t := &faultTransport{base: base}
+	for _, part := range strings.Split(spec, ",") {
+		k, v, ok := strings.Cut(strings.TrimSpace(part), ":")
+		if !ok {
+			return nil, fmt.Errorf("invalid CENTRAL_MCP_FAULT entry %q (want key:value)", part)
+		}
+		var err error
+		switch k {
+		case "latency":
+			t.latency, err = time.ParseDuration(v)
+		case "error-rate":
+			t.errorRate, err = strconv.ParseFloat(v, 64)
+			if err == nil && (t.errorRate < 0 || t.errorRate > 1) {
+				err = errors.New("must be between 0 and 1")
+			}
+		default:
+			return nil, fmt.Errorf("unknown CENTRAL_MCP_FAULT key %q (want latency or error-rate)", k)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid CENTRAL_MCP_FAULT %s: %w", k, err)
+		}
+	}
+	return t, nil
+}
+
+func (t *faultTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.latency > 0 {
+		select {
+		case <-time.After(t.latency):
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+	}
+	if t.errorRate > 0 && mrand.Float64() < t.errorRate {
+		return nil, errors.New("injected fault (CENTRAL_MCP_FAULT)")
+	}
+	return t.base.RoundTrip(req)
+}
+
+// interaction is one recorded request/response pair in a cassette.
+type interaction struct {
+	Method string      `json:"method"`
+	Path   string      `json:"path"`
+	Status int         `json:"status"`
+	Header http.Header `json:"header"`
+	Body   []byte      `json:"body"`
+}
+
+// cassette records server interactions to an encrypted file
+// (CENTRAL_MCP_CASSETTE_MODE=record) or replays them without touching the
+// network (the default), so integration tests can run offline in CI. The file
+// is sealed with AES-GCM under a key derived from CENTRAL_MCP_CASSETTE_KEY,
+// since recorded bodies contain real secret values. Requests are matched by
+// method and path in recorded order; credentials are never recorded.
+type cassette struct {
+	path   string
+	record bool
+	base   http.RoundTripper
+	gcm    cipher.AEAD
+	mu     sync.Mutex
+	tape   []interaction
+	used   []bool
+}
+
+func newCassette(path, mode, key string, base http.RoundTripper) (*cassette, error) {
+	if key == "" {
+		return nil, errors.New("CENTRAL_MCP_CASSETTE is set but CENTRAL_MCP_CASSETTE_KEY is not")
+	}
+	sum := sha256.Sum256([]byte("central-mcp cassette\n" + key))
+	block, err := aes.NewCipher(sum[:])
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	c := &cassette{path: path, base: base, gcm: gcm}
+	switch mode {
+	case "record":
+		c.record = true
+		return c, nil
+	case "", "replay":
+	default:
+		return nil, fmt.Errorf("invalid CENTRAL_MCP_CASSETTE_MODE %q (want record or replay)", mode)
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read cassette: %w", err)
+	}
+	if len(b) < gcm.NonceSize() {
+		return nil, fmt.Errorf("cassette %s is truncated", path)
+	}
+	pt, err := gcm.Open(nil, b[:gcm.NonceSize()], b[gcm.NonceSize():], nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt cassette %s (wrong CENTRAL_MCP_CASSETTE_KEY?)", path)
+	}
+	err = json.Unmarshal(pt, &c.tape)
+	clear(pt)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse cassette %s: %w", path, err)
+	}
+	c.used = make([]bool, len(c.tape))
+	return c, nil
+}
+
+func (c *cassette) RoundTrip(req *http.Request) (*http.Response, error) {
+	if c.record {
+		return c.recordTrip(req)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i, it := range c.tape {
+		if c.used[i] || it.Method != req.Method || it.Path != req.URL.RequestURI() {
+			continue
+		}
+		c.used[i] = true
+		return &http.Response{
+			Status:        fmt.Sprintf("%d %s", it.Status, http.StatusText(it.Status)),
+			StatusCode:    it.Status,
+			Proto:         "HTTP/1.1",
+			ProtoMajor:    1,
+			ProtoMinor:    1,
+			Header:        it.Header.Clone(),
+			Body:          io.NopCloser(bytes.NewReader(it.Body)),
+			ContentLength: int64(len(it.Body)),
+			Request:       req,
+		}, nil
+	}
+	return nil, fmt.Errorf("cassette %s has no recorded %s %s", c.path, req.Method, req.URL.RequestURI())
+}
+
+func (c *cassette) recordTrip(req *http.Request) (*http.Response, error) {
+	resp, err := c.base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	b, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(b))
+	h := resp.Header.Clone()
+	// a replayed Date would trip the clock skew warning
+	h.Del("Date")
+	h.Del("Set-Cookie")
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.tape = append(c.tape, interaction{Method: req.Method, Path: req.URL.RequestURI(), Status: resp.StatusCode, Header: h, Body: b})
+	pt, err := json.Marshal(c.tape)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, c.gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	ct := c.gcm.Seal(nonce, nonce, pt, nil)
+	clear(pt)
+	if err := writeFileAtomic(c.path, ct, 0o600); err != nil {
+		return nil, fmt.Errorf("failed to write cassette: %w", err)
+	}
+	return resp, nil
+}
+
+// fipsTLSConfig verifies the FIPS 140 module is enabled (GODEBUG=fips140=on
+// or a GOFIPS140 build) and returns a TLS config limited to approved
+// algorithms: TLS 1.2+, ECDHE with AES-GCM, P-256/P-384.
+func fipsTLSConfig() (*tls.Config, error) {
+	if !fips140.Enabled() {
+		return nil, errors.New("FIPS mode requested but the Go FIPS 140 module is not enabled (set GODEBUG=fips140=on or build with GOFIPS140)")
+	}
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		CipherSuites: []uint16{
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+		},
+		CurvePreferences: []tls.CurveID{tls.CurveP256, tls.CurveP384},
+	}, nil
+}
+
+func (c *Config) leeway() (time.Duration, error) {
+	if c.ClockSkewLeeway == "" {
+		return time.Minute, nil
+	}
+	d, err := time.ParseDuration(c.ClockSkewLeeway)
+	if err != nil {
+		return 0, fmt.Errorf("invalid clockSkewLeeway %q: %w", c.ClockSkewLeeway, err)
+	}
+	return d, nil
+}
+
+func (c *Config) defaultCacheTTL() (time.Duration, error) {
+	if c.DefaultCacheTTL == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(c.DefaultCacheTTL)
+	if err != nil {
+		return 0, fmt.Errorf("invalid defaultCacheTtl %q: %w", c.DefaultCacheTTL, err)
+	}
+	return d, nil
+}
+
+// clockTransport compares each response's Date header with the local clock
+// and warns once when they differ by more than leeway, since skew otherwise
+// surfaces as confusing JWT validation failures.
+type clockTransport struct {
+	base   http.RoundTripper
+	leeway time.Duration
+	warned atomic.Bool
+}
+
+func (t *clockTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.base.RoundTrip(req)
+	if err != nil || t.warned.Load() {
+		return resp, err
+	}
+	// CompareAndSwap so concurrent requests print the warning only once
+	if skew, ok := serverSkew(resp); ok && (skew > t.leeway || skew < -t.leeway) && t.warned.CompareAndSwap(false, true) {
+		fmt.Fprintf(stderr, "warning: clock skew detected: %s (server ahead if positive); check NTP\n", skew)
+	}
+	return resp, nil
+}
+
+// serverSkew returns server time minus local time from the Date header.
+func serverSkew(resp *http.Response) (time.Duration, bool) {
+	d, err := http.ParseTime(resp.Header.Get("Date"))
+	if err != nil {
+		return 0, false
+	}
+	return time.Until(d).Round(time.Second), true
+}
+
+// jwtClaims decodes (without verifying) the claims segment of a JWT.
+func jwtClaims(token string) (map[string]any, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("token is not a JWT")
+	}
+	b, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("invalid JWT payload: %w", err)
+	}
+	var claims map[string]any
+	if err := decodeJSON(b, &claims); err != nil {
+		return nil, fmt.Errorf("invalid JWT payload: %w", err)
+	}
+	return claims, nil
+}
+
+// checkTokenTimes warns when a freshly issued JWT looks issued in the future
+// or already expired by the local clock, beyond leeway.
+func checkTokenTimes(token string, leeway time.Duration) {
+	claims, err := jwtClaims(token)
+	if err != nil {
+		return
+	}
+	now := time.Now()
+	if iat, ok := claims["iat"].(float64); ok {
+		if d := time.Unix(int64(iat), 0).Sub(now); d > leeway || d < -leeway {
+			fmt.Fprintf(stderr, "warning: clock skew detected: %s between token iat and local time\n", d.Round(time.Second))
+		}
+	}
+	if exp, ok := claims["exp"].(float64); ok && now.After(time.Unix(int64(exp), 0).Add(leeway)) {
+		fmt.Fprintln(stderr, "warning: token is already expired by the local clock; check NTP")
+	}
+}
+
+const defaultMaxResponseBytes = 4 << 20
+
+// limitTransport requests gzip itself and caps response bodies (after
+// decompression) at max bytes, so a malicious or buggy server produces a
+// clear error rather than exhausting memory.
+type limitTransport struct {
+	base http.RoundTripper
+	max  int64
+}
+
+func (t *limitTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Header.Get("Accept-Encoding") == "" {
+		req = req.Clone(req.Context())
+		req.Header.Set("Accept-Encoding", "gzip")
+	}
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.ContentLength > t.max {
+		resp.Body.Close()
+		return nil, fmt.Errorf("response from %s is %d bytes, over the %d byte limit", req.URL.Path, resp.ContentLength, t.max)
+	}
+	body := resp.Body
+	if strings.EqualFold(resp.Header.Get("Content-Encoding"), "gzip") {
+		zr, err := gzip.NewReader(io.LimitReader(body, t.max))
+		if err != nil {
+			body.Close()
+			return nil, fmt.Errorf("invalid gzip response from %s: %w", req.URL.Path, err)
+		}
+		resp.Header.Del("Content-Encoding")
+		resp.Header.Del("Content-Length")
+		resp.ContentLength = -1
+		resp.Uncompressed = true
+		body = &gzipBody{Reader: zr, raw: body}
+	}
+	resp.Body = &limitedBody{rc: body, left: t.max, max: t.max, path: req.URL.Path}
+	return resp, nil
+}
+
+type gzipBody struct {
+	*gzip.Reader
+	raw io.ReadCloser
+}
+
+func (b *gzipBody) Close() error {
+	b.Reader.Close()
+	return b.raw.Close()
+}
+
+// limitedBody fails reads once more than max bytes have been produced.
+type limitedBody struct {
+	rc   io.ReadCloser
+	left int64
+	max  int64
+	path string
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if b.left <= 0 {
+		// probe for one more byte to distinguish EOF from overflow
+		var one [1]byte
+		if n, _ := b.rc.Read(one[:]); n > 0 {
+			return 0, fmt.Errorf("response from %s exceeds the %d byte limit", b.path, b.max)
+		}
+		return 0, io.EOF
+	}
+	if int64(len(p)) > b.left {
+		p = p[:b.left]
+	}
+	n, err := b.rc.Read(p)
+	b.left -= int64(n)
+	return n, err
+}
+
+func (b *limitedBody) Close() error { return b.rc.Close() }
+
+// ping checks reachability of the server's /health endpoint and reports which
+// address (and so which IP family) the connection used.
+func ping(client *http.Client, serverURL string) (string, error) {
+	if serverURL == "" {
+		return "", errors.New("server URL is empty")
+	}
+	var remote string
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			remote = info.Conn.RemoteAddr().String()
+		},
+	}
+	req, err := http.NewRequest("GET", apiBase(serverURL)+"/health", nil)
+	if err != nil {
+		return "", err
+	}
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode != 200 {
+		return "", &httpError{resp.StatusCode, fmt.Sprintf("health check returned %d", resp.StatusCode)}
+	}
+	return fmt.Sprintf("%s: status %d via %s in %s", serverURL, resp.StatusCode, remote, time.Since(start).Round(time.Millisecond)), nil
+}
+
+// runDoctor prints a diagnostic report about the runtime environment, config
+// discovery, proxies, server reachability, clock skew and TLS chain, suitable
+// for attaching to issues. It returns false if any check failed.
+func runDoctor(cfg *Config, client *http.Client) bool {
+	ok := true
+	fmt.Println("central-mcp doctor")
+	fmt.Printf("  runtime: %s/%s %s\n", runtime.GOOS, runtime.GOARCH, runtime.Version())
+	fmt.Println("  fips140 module enabled:", fips140.Enabled())
+
+	fmt.Println("  config files:")
+	for _, p := range configCandidates() {
+		state := "absent"
+		if fileExists(p) {
+			state = "present"
+			if p == cfg.path {
+				state = "loaded"
+			}
+		}
+		fmt.Printf("    %s: %s\n", p, state)
+	}
+	if cfg.path != "" && !cfg.encrypted {
+		if err := checkConfigPermissions(cfg); err != nil {
+			fmt.Println("    FAIL:", err)
+			ok = false
+		}
+	}
+	fmt.Println("  serverUrl:", cfg.CentralMcpServerUrl)
+	fmt.Println("  serverToken set:", cfg.CentralMcpServerToken != "")
+	fmt.Println("  jwtSecret set:", cfg.CentralMcpJwtSecret != "")
+
+	fmt.Println("  proxy:")
+	for _, k := range []string{"HTTPS_PROXY", "HTTP_PROXY", "NO_PROXY"} {
+		v := os.Getenv(k)
+		if v == "" {
+			v = os.Getenv(strings.ToLower(k))
+		}
+		if u, err := url.Parse(v); err == nil && u.User != nil {
+			v = u.Redacted()
+		}
+		fmt.Printf("    %s=%s\n", k, v)
+	}
+
+	if cfg.CentralMcpServerUrl == "" {
+		fmt.Println("  server: FAIL: no server URL configured")
+		return false
+	}
+	req, err := http.NewRequest("GET", apiBase(cfg.CentralMcpServerUrl)+"/health", nil)
+	if err != nil {
+		fmt.Println("  server: FAIL:", err)
+		return false
+	}
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		fmt.Println("  server: FAIL:", err)
+		return false
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	fmt.Printf("  server: status %d in %s\n", resp.StatusCode, time.Since(start).Round(time.Millisecond))
+	if resp.StatusCode != 200 {
+		ok = false
+	}
+
+	if skew, known := serverSkew(resp); known {
+		leeway, _ := cfg.leeway()
+		if skew > leeway || skew < -leeway {
+			fmt.Printf("  clock skew vs server: FAIL: %s exceeds leeway %s\n", skew, leeway)
+			ok = false
+		} else {
+			fmt.Println("  clock skew vs server:", skew)
+		}
+	} else {
+		fmt.Println("  clock skew vs server: unknown (no Date header)")
+	}
+
+	if resp.TLS != nil {
+		fmt.Printf("  tls: %s, %s\n", tls.VersionName(resp.TLS.Version), tls.CipherSuiteName(resp.TLS.CipherSuite))
+		for i, c := range resp.TLS.PeerCertificates {
+			fmt.Printf("    [%d] %s (issuer %s, expires %s)\n", i, c.Subject, c.Issuer, c.NotAfter.Format(time.RFC3339))
+			if time.Until(c.NotAfter) < 14*24*time.Hour {
+				fmt.Println("        WARN: expires within 14 days")
+			}
+		}
+	}
+	return ok
+}
+
+// requestJWT exchanges the server token for a JWT. A non-empty scope is sent
+// as an OAuth-style form parameter asking for a narrower token.
+func requestJWT(client *http.Client, serverURL, serverToken, scope string) (string, error) {
+	if serverURL == "" {
+		return "", errors.New("server URL is empty")
+	}
+	if serverToken == "" {
+		return "", errors.New("server token is empty")
+	}
+	var body io.Reader
+	if scope != "" {
+		body = strings.NewReader(url.Values{"scope": {scope}}.Encode())
+	}
+	req, err := http.NewRequest("POST", apiBase(serverURL)+"/token", body)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Authorization", "Bearer "+serverToken)
+	if scope != "" {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != 200 {
+		return "", &httpError{resp.StatusCode, fmt.Sprintf("token request failed %d: %s", resp.StatusCode, snippet(b))}
+	}
+	var out struct {
+		AccessToken string `json:"access_token"`
+	}
+	err = decodeJSON(b, &out)
+	clear(b)
+	if err != nil {
+		return "", err
+	}
+	if out.AccessToken == "" {
+		return "", errors.New("no access_token in response")
+	}
+	return out.AccessToken, nil
+}
+
+// inspectToken obtains a JWT the way secret reads do and prints its claims
+// and validity window, plus whether the server still considers it active when
+// it offers /token/introspect (RFC 7662 style). The token itself is never
+// printed.
+func inspectToken(w io.Writer, f *fetcher) error {
+	if f.cfg.CentralMcpServerUrl == "" {
+		return &exitError{2, errors.New("no server URL configured (env CENTRAL_MCP_SERVER_URL or central-mcp-config.json)")}
+	}
+	if f.sign {
+		return &exitError{2, errors.New("-sign does not use a JWT; there is no token to inspect")}
+	}
+	if err := f.authorize(); err != nil {
+		return err
+	}
+	auth, jwt := f.credentials()
+	claims, err := jwtClaims(jwt)
+	if err != nil {
+		return &exitError{3, err}
+	}
+	str := func(k string) string {
+		if v, ok := claims[k].(string); ok && v != "" {
+			return v
+		}
+		return "(none)"
+	}
+	at := func(k string) string {
+		v, ok := claims[k].(float64)
+		if !ok {
+			return "(none)"
+		}
+		t := time.Unix(int64(v), 0)
+		if d := time.Until(t).Round(time.Second); d >= 0 {
+			return fmt.Sprintf("%s (in %s)", t.Format(time.RFC3339), d)
+		}
+		return fmt.Sprintf("%s (%s ago)", t.Format(time.RFC3339), -time.Until(t).Round(time.Second))
+	}
+	fmt.Fprintln(w, "token:")
+	fmt.Fprintln(w, "  issuer:", str("iss"))
+	fmt.Fprintln(w, "  subject:", str("sub"))
+	fmt.Fprintln(w, "  scope:", str("scope"))
+	fmt.Fprintln(w, "  issued at:", at("iat"))
+	fmt.Fprintln(w, "  expires at:", at("exp"))
+	var other []string
+	for k := range claims {
+		switch k {
+		case "iss", "sub", "scope", "iat", "exp":
+		default:
+			other = append(other, k)
+		}
+	}
+	sort.Strings(other)
+	for _, k := range other {
+		b, _ := json.Marshal(claims[k])
+		fmt.Fprintf(w, "  %s: %s\n", k, b)
+	}
+
+	var resp struct {
+		Active bool `json:"active"`
+	}
+	err = doJSON(f.client, auth, "POST", apiBase(f.cfg.CentralMcpServerUrl)+"/token/introspect", map[string]string{"token": jwt}, &resp)
+	switch {
+	case err == nil && resp.Active:
+		fmt.Fprintln(w, "  status: active")
+	case err == nil:
+		fmt.Fprintln(w, "  status: inactive (revoked or expired)")
+	default:
+		fmt.Fprintln(w, "  status: unknown:", err)
+	}
+	return nil
+}
+
+// checkTokenScope warns when the server ignored a requested scope, since the
+// token may then carry the bootstrap token's full privileges.
+func checkTokenScope(token, want string) {
+	claims, err := jwtClaims(token)
+	if err != nil {
+		return
+	}
+	got, _ := claims["scope"].(string)
+	granted := strings.Fields(got)
+	narrowed := len(granted) > 0
+	for _, g := range granted {
+		narrowed = narrowed && slices.Contains(strings.Fields(want), g)
+	}
+	if !narrowed {
+		fmt.Fprintf(stderr, "warning: server did not narrow the token to scope %q (got %q); it may carry full privileges\n", want, got)
+	}
+}
+
+// bearerAuth authorizes requests with a bearer token (normally the JWT from /token).
+func bearerAuth(token string) func(*http.Request, []byte) error {
+	return func(req *http.Request, _ []byte) error {
+		req.Header.Set("Authorization", "Bearer "+token)
+		return nil
+	}
+}
+
+// hmacAuth signs requests with the shared JWT secret instead of sending a
+// bearer header. The signature covers timestamp, nonce, method, path and a
+// hash of the body; the server rejects stale timestamps and reused nonces.
+func hmacAuth(secret string) func(*http.Request, []byte) error {
+	return func(req *http.Request, body []byte) error {
+		if secret == "" {
+			return errors.New("jwt secret is empty")
+		}
+		n := make([]byte, 16)
+		if _, err := rand.Read(n); err != nil {
+			return err
+		}
+		ts := strconv.FormatInt(time.Now().Unix(), 10)
+		nonce := hex.EncodeToString(n)
+		req.Header.Set("X-Central-Mcp-Timestamp", ts)
+		req.Header.Set("X-Central-Mcp-Nonce", nonce)
+		req.Header.Set("X-Central-Mcp-Signature", signRequest(secret, ts, nonce, req.Method, req.URL.EscapedPath(), body))
+		return nil
+	}
+}
+
+// withHeader sets a header on each request before handing it to auth.
+func withHeader(auth func(*http.Request, []byte) error, key, value string) func(*http.Request, []byte) error {
+	return func(req *http.Request, body []byte) error {
+		req.Header.Set(key, value)
+		return auth(req, body)
+	}
+}
+
+func signRequest(secret, ts, nonce, method, path string, body []byte) string {
+	bh := sha256.Sum256(body)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(ts + "\n" + nonce + "\n" + method + "\n" + path + "\n" + hex.EncodeToString(bh[:])))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Limits applied to JSON from the server, resolvers and operator files before
+// it is decoded, so a hostile or broken peer cannot make the tool chew through
+// deeply nested or enormous documents.
+const (
+	maxJSONDepth     = 64
+	maxJSONStringLen = 1 << 20
+	maxErrorBodyLen  = 512
+)
+
+// decodeJSON checks b against the nesting and string length limits and then
+// unmarshals it into v.
+func decodeJSON(b []byte, v any) error {
+	if err := checkJSONLimits(b); err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// checkJSONLimits rejects documents nested deeper than maxJSONDepth or with a
+// string longer than maxJSONStringLen, without decoding them.
+func checkJSONLimits(b []byte) error {
+	depth, strStart, inStr, esc := 0, 0, false, false
+	for i, c := range b {
+		if inStr {
+			switch {
+			case esc:
+				esc = false
+			case c == '\\':
+				esc = true
+			case c == '"':
+				inStr = false
+				if i-strStart > maxJSONStringLen {
+					return fmt.Errorf("JSON string longer than %d bytes", maxJSONStringLen)
+				}
+			}
+			continue
+		}
+		switch c {
+		case '"':
+			inStr, strStart = true, i
+		case '{', '[':
+			if depth++; depth > maxJSONDepth {
+				return fmt.Errorf("JSON nested deeper than %d levels", maxJSONDepth)
+			}
+		case '}', ']':
+			depth--
+		}
+	}
+	return nil
+}
+
+// snippet shortens an error response body for inclusion in a message.
+func snippet(b []byte) string {
+	s := strings.TrimSpace(string(b))
+	if len(s) > maxErrorBodyLen {
+		return s[:maxErrorBodyLen] + "..."
+	}
+	return s
+}
+
+// statusError is a non-200 answer to a secret request.
+type statusError struct {
+	Code int
+	Body string
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("secret request failed %d: %s", e.Code, e.Body)
+}
+
+// httpError is a non-200 answer from /health or /token.
+type httpError struct {
+	Code int
+	msg  string
+}
+
+func (e *httpError) Error() string { return e.msg }
+
+func isNotFound(err error) bool {
+	var se *statusError
+	return errors.As(err, &se) && se.Code == http.StatusNotFound
+}
+
+func isAuthFailure(err error) bool {
+	var se *statusError
+	return errors.As(err, &se) && (se.Code == http.StatusUnauthorized || se.Code == http.StatusForbidden)
+}
+
+// errNotModified is returned by getSecret when the server answers a
+// conditional request with 304.
+var errNotModified = errors.New("secret not modified")
+
+// getSecret fetches a secret value and its ETag. If etag is set it is sent as
+// If-None-Match, and errNotModified reports that the cached value is current.
+func getSecret(client *http.Client, serverURL string, auth func(*http.Request, []byte) error, name, etag string) (string, string, error) {
+	if serverURL == "" {
+		return "", "", errors.New("server URL is empty")
+	}
+	req, err := http.NewRequest("GET", apiBase(serverURL)+"/secrets/"+urlEscape(name), nil)
+	if err != nil {
+		return "", "", err
+	}
+	if etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+	if err := auth(req, nil); err != nil {
+		return "", "", err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotModified {
+		return "", etag, errNotModified
+	}
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", "", err
+	}
+	if resp.StatusCode != 200 {
+		return "", "", &statusError{Code: resp.StatusCode, Body: snippet(b)}
+	}
+	var out struct {
+		Name  string `json:"name"`
+		Value string `json:"value"`
+	}
+	err = decodeJSON(b, &out)
+	clear(b)
+	if err != nil {
+		return "", "", err
+	}
+	return out.Value, resp.Header.Get("ETag"), nil
+}
+
+// resolverFor returns the external resolver command for names of the form
+// "prefix:rest", along with rest.
+func (c *Config) resolverFor(name string) ([]string, string, bool) {
+	prefix, rest, ok := strings.Cut(name, ":")
+	if !ok {
+		return nil, "", false
+	}
+	cmd, ok := c.Resolvers[prefix]
+	if !ok || len(cmd) == 0 {
+		return nil, "", false
+	}
+	return cmd, rest, true
+}
+
+// defaultResolverTimeout applies when timeouts.resolver is unset.
+const defaultResolverTimeout = 30 * time.Second
+
+// runResolver invokes an external resolver plugin. The plugin receives
+// {"name": ...} on stdin and must answer {"value": ...} or {"error": ...} on
+// stdout within timeout, or it is killed.
+func runResolver(command []string, name string, timeout time.Duration) (string, error) {
+	in, err := json.Marshal(map[string]string{"name": name})
+	if err != nil {
+		return "", err
+	}
+	if timeout <= 0 {
+		timeout = defaultResolverTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, command[0], command[1:]...)
+	cmd.Stdin = bytes.NewReader(in)
+	cmd.Stderr = &stderr
+	// a grandchild holding stdout open must not outlive the kill
+	cmd.WaitDelay = time.Second
+	b, err := cmd.Output()
+	if ctx.Err() == context.DeadlineExceeded {
+		return "", fmt.Errorf("resolver %s: timed out after %s", command[0], timeout)
+	}
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return "", fmt.Errorf("resolver %s: %w: %s", command[0], err, msg)
+		}
+		return "", fmt.Errorf("resolver %s: %w", command[0], err)
+	}
+	var out struct {
+		Value string `json:"value"`
+		Error string `json:"error"`
+	}
+	err = decodeJSON(b, &out)
+	clear(b)
+	if err != nil {
+		return "", fmt.Errorf("resolver %s: invalid response: %w", command[0], err)
+	}
+	if out.Error != "" {
+		return "", fmt.Errorf("resolver %s: %s", command[0], out.Error)
+	}
+	return out.Value, nil
+}
+
+// diskCache is an opt-in on-disk cache of fetched secret values, encrypted
+// with AES-GCM under a key derived from the JWT secret. It lets CI pipelines
+// that read the same secrets repeatedly skip the network within the TTL.
+type diskCache struct {
+	dir string
+	gcm cipher.AEAD
+}
+
+type cacheEntry struct {
+	Value   string    `json:"value"`
+	ETag    string    `json:"etag,omitempty"`
+	Expires time.Time `json:"expires"`
+}
+
+func (e *cacheEntry) fresh() bool { return time.Now().Before(e.Expires) }
+
+func cacheDir() (string, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "central-mcp"), nil
+}
+
+func newDiskCache(jwtSecret string) (*diskCache, error) {
+	if jwtSecret == "" {
+		return nil, errors.New("the cache is encrypted with the JWT secret, which is not configured")
+	}
+	dir, err := cacheDir()
+	if err != nil {
+		return nil, err
+	}
+	key := sha256.Sum256([]byte("central-mcp cache\n" + jwtSecret))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &diskCache{dir: dir, gcm: gcm}, nil
+}
+
+func (c *diskCache) file(serverURL, name string) string {
+	h := sha256.Sum256([]byte(strings.TrimRight(serverURL, "/") + "\n" + name))
+	return filepath.Join(c.dir, hex.EncodeToString(h[:]))
+}
+
+// get returns the cached entry, or nil if it is missing or undecryptable.
+// Expired entries are still returned so their ETag can be revalidated.
+func (c *diskCache) get(serverURL, name string) *cacheEntry {
+	b, err := os.ReadFile(c.file(serverURL, name))
+	if err != nil || len(b) < c.gcm.NonceSize() {
+		return nil
+	}
+	nonce, ct := b[:c.gcm.NonceSize()], b[c.gcm.NonceSize():]
+	pt, err := c.gcm.Open(nil, nonce, ct, []byte(name))
+	if err != nil {
+		return nil
+	}
+	var e cacheEntry
+	err = json.Unmarshal(pt, &e)
+	clear(pt)
+	if err != nil {
+		return nil
+	}
+	return &e
+}
+
+func (c *diskCache) put(serverURL, name, value, etag string, ttl time.Duration) error {
+	pt, err := json.Marshal(cacheEntry{Value: value, ETag: etag, Expires: time.Now().Add(ttl)})
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, c.gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(c.dir, 0o700); err != nil {
+		return err
+	}
+	ct := c.gcm.Seal(nonce, nonce, pt, []byte(name))
+	clear(pt)
+	// concurrent clients must never read a half-written entry
+	return writeFileAtomic(c.file(serverURL, name), ct, 0o600)
+}
+
+// cacheTTLFor returns the per-secret TTL from config, or def.
+func (c *Config) cacheTTLFor(name string, def time.Duration) (time.Duration, error) {
+	v, ok := c.CacheTTL[name]
+	if !ok {
+		return def, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return 0, fmt.Errorf("invalid cacheTtl for %s: %w", name, err)
+	}
+	return d, nil
+}
+
+const maxSecretNameLen = 256
+
+// normalizeSecretName applies the canonical naming rules: "/"-separated
+// segments of letters, digits, '.', '_' and '-', no empty or dot-only
+// segments, at most 256 characters. Surrounding whitespace and slashes are
+// trimmed, repeated slashes collapsed, and with nameCase "lower" the name is
+// lowercased.
+func normalizeSecretName(name, nameCase string) (string, error) {
+	n := strings.Trim(strings.TrimSpace(name), "/")
+	for strings.Contains(n, "//") {
+		n = strings.ReplaceAll(n, "//", "/")
+	}
+	switch nameCase {
+	case "":
+	case "lower":
+		n = strings.ToLower(n)
+	default:
+		return "", fmt.Errorf("invalid nameCase %q (want lower or empty)", nameCase)
+	}
+	if n == "" {
+		return "", errors.New("secret name is empty")
+	}
+	if len(n) > maxSecretNameLen {
+		return "", fmt.Errorf("secret name is %d characters, over the %d limit", len(n), maxSecretNameLen)
+	}
+	for _, seg := range strings.Split(n, "/") {
+		if seg == "." || seg == ".." {
+			return "", fmt.Errorf("secret name %q has a %q segment", name, seg)
+		}
+		for _, r := range seg {
+			if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '.' || r == '_' || r == '-') {
+				return "", fmt.Errorf("secret name %q contains invalid character %q", name, r)
+			}
+		}
+	}
+	return n, nil
+}
+
+// nonConformingNames reports local secret names that are not already in
+// canonical form, with the reason or the suggested replacement.
+func nonConformingNames(secrets map[string]Secret, nameCase string) []string {
+	var out []string
+	for k := range secrets {
+		n, err := normalizeSecretName(k, nameCase)
+		switch {
+		case err != nil:
+			out = append(out, fmt.Sprintf("%s: %v", k, err))
+		case n != k:
+			out = append(out, fmt.Sprintf("%s: rename to %s", k, n))
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+// exitError carries the process exit code for a failure: 1 config, 2 usage
+// or missing settings, 3 token, 4 secret fetch.
+type exitError struct {
+	code int
+	err  error
+}
+
+func (e *exitError) Error() string { return e.err.Error() }
+func (e *exitError) Unwrap() error { return e.err }
+
+func exitCode(err error) int {
+	var ee *exitError
+	if errors.As(err, &ee) {
+		return ee.code
+	}
+	return 1
+}
+
+// fetcher resolves secret names through resolvers, the disk cache and the
+// server, obtaining a JWT lazily on first use so cache hits and resolver
+// lookups never touch /token.
+type fetcher struct {
+	cfg    *Config
+	client *http.Client
+	sign   bool
+	reason string
+	// scope, when set, asks /token for a reduced-privilege JWT
+	scope string
+	ttl   time.Duration
+	cache *diskCache
+	auth  func(*http.Request, []byte) error
+	// jwt is the token behind auth, when one was requested from /token
+	jwt string
+	// resolverTimeout bounds each resolver plugin run
+	resolverTimeout time.Duration
+
+	// authMu guards auth and jwt, so concurrent callers share one /token
+	// request; mu guards cache and flights.
+	authMu  sync.Mutex
+	mu      sync.Mutex
+	flights map[string]*flight
+}
+
+// newFetcher builds the fetcher every mode shares from the resolved
+// -sign, -scope, -reason and -cache-ttl settings.
+func newFetcher(cfg *Config, client *http.Client) (*fetcher, error) {
+	ttl, err := cfg.defaultCacheTTL()
+	if err != nil {
+		return nil, err
+	}
+	resolverTimeout, err := parseTimeout("resolver", cfg.Timeouts.Resolver, defaultResolverTimeout)
+	if err != nil {
+		return nil, err
+	}
+	return &fetcher{cfg: cfg, client: client, sign: cfg.Sign, scope: cfg.Scope, reason: cfg.Reason, ttl: ttl, resolverTimeout: resolverTimeout}, nil
+}
+
+// flight is an in-progress fetch that concurrent gets for the same name wait
+// on instead of issuing their own upstream request.
+type flight struct {
+	done chan struct{}
+	val  string
+	err  error
+}
+
+func (f *fetcher) authorize() error {
+	f.authMu.Lock()
+	defer f.authMu.Unlock()
+	if f.auth != nil {
+		return nil
+	}
+	cfg := f.cfg
+	if f.sign {
+		if cfg.CentralMcpJwtSecret == "" {
+			return &exitError{2, errors.New("no JWT secret configured for -sign (env CENTRAL_MCP_JWT_SECRET or central-mcp-config.json)")}
+		}
+		f.auth = hmacAuth(cfg.CentralMcpJwtSecret.Reveal())
+	} else {
+		if cfg.CentralMcpServerToken == "" {
+			return &exitError{2, errors.New("no server token configured (env CENTRAL_MCP_SERVER_TOKEN or central-mcp-config.json)")}
+		}
+		jwt, err := requestJWT(f.client, cfg.CentralMcpServerUrl, cfg.CentralMcpServerToken.Reveal(), f.scope)
+		if err != nil {
+			return &exitError{3, fmt.Errorf("failed to obtain JWT: %w", err)}
+		}
+		knownSecrets.add(jwt)
+		f.jwt = jwt
+		if f.scope != "" {
+			checkTokenScope(jwt, f.scope)
+		}
+		if leeway, err := cfg.leeway(); err == nil {
+			checkTokenTimes(jwt, leeway)
+		}
+		f.auth = bearerAuth(jwt)
+	}
+	if f.reason != "" {
+		f.auth = withHeader(f.auth, "X-Central-Mcp-Reason", f.reason)
+	}
+	return nil
+}
+
+// credentials returns the current auth decorator and the JWT behind it.
+func (f *fetcher) credentials() (func(*http.Request, []byte) error, string) {
+	f.authMu.Lock()
+	defer f.authMu.Unlock()
+	return f.auth, f.jwt
+}
+
+// get fetches a secret. It is safe for concurrent use: simultaneous gets for
+// the same name share a single upstream fetch.
+func (f *fetcher) get(raw string) (string, error) {
+	f.mu.Lock()
+	if fl, ok := f.flights[raw]; ok {
+		f.mu.Unlock()
+		<-fl.done
+		return fl.val, fl.err
+	}
+	fl := &flight{done: make(chan struct{})}
+	if f.flights == nil {
+		f.flights = map[string]*flight{}
+	}
+	f.flights[raw] = fl
+	f.mu.Unlock()
+
+	fl.val, fl.err = f.fetch(raw)
+	f.mu.Lock()
+	delete(f.flights, raw)
+	f.mu.Unlock()
+	close(fl.done)
+	return fl.val, fl.err
+}
+
+func (f *fetcher) fetch(raw string) (string, error) {
+	cfg := f.cfg
+	// resolver reads are secret reads too
+	if cfg.RequireReason && strings.TrimSpace(f.reason) == "" {
+		return "", &exitError{2, errors.New("a -reason is required to read secrets (requireReason is set in config)")}
+	}
+
+	if command, name, ok := cfg.resolverFor(raw); ok {
+		val, err := runResolver(command, name, f.resolverTimeout)
+		if err != nil {
+			return "", &exitError{4, fmt.Errorf("failed to resolve secret: %w", err)}
+		}
+		knownSecrets.add(val)
+		return val, nil
+	}
+
+	// Need server URL and server token (either from env/file)
+	if cfg.CentralMcpServerUrl == "" {
+		return "", &exitError{2, errors.New("no server URL configured (env CENTRAL_MCP_SERVER_URL or central-mcp-config.json)")}
+	}
+	name, err := normalizeSecretName(raw, cfg.NameCase)
+	if err != nil {
+		if cfg.NamePolicy == "strict" {
+			return "", &exitError{2, fmt.Errorf("invalid secret name: %w", err)}
+		}
+		// names that predate the rules must stay readable
+		fmt.Fprintf(stderr, "warning: %v; reading it as given (namePolicy strict would refuse it)\n", err)
+		name = raw
+	}
+
+	ttl, err := cfg.cacheTTLFor(name, f.ttl)
+	if err != nil {
+		return "", &exitError{1, fmt.Errorf("failed to load config: %w", err)}
+	}
+	var cached *cacheEntry
+	var cache *diskCache
+	if ttl > 0 {
+		f.mu.Lock()
+		if f.cache == nil {
+			f.cache, err = newDiskCache(cfg.CentralMcpJwtSecret.Reveal())
+		}
+		cache = f.cache
+		f.mu.Unlock()
+		if err != nil {
+			return "", &exitError{1, fmt.Errorf("failed to open cache: %w", err)}
+		}
+		// reads with a reason must reach the server so they get audited
+		if cached = cache.get(cfg.CentralMcpServerUrl, name); cached != nil && cached.fresh() && f.reason == "" {
+			knownSecrets.add(cached.Value)
+			return cached.Value, nil
+		}
+	}
+
+	if err := f.authorize(); err != nil {
+		return "", err
+	}
+	// prevETag is sent as If-None-Match on every attempt; etag is the answer
+	var prevETag string
+	if cached != nil {
+		prevETag = cached.ETag
+	}
+	auth, jwt := f.credentials()
+	val, etag, err := getSecret(f.client, cfg.CentralMcpServerUrl, auth, name, prevETag)
+	if isAuthFailure(err) && !f.sign {
+		// the JWT may have expired in a long-running exec; get a new one once,
+		// unless a concurrent get already did
+		f.authMu.Lock()
+		if f.jwt == jwt {
+			f.auth = nil
+		}
+		f.authMu.Unlock()
+		if err := f.authorize(); err != nil {
+			return "", err
+		}
+		auth, _ = f.credentials()
+		val, etag, err = getSecret(f.client, cfg.CentralMcpServerUrl, auth, name, prevETag)
+	}
+	if err == errNotModified {
+		val, err = cached.Value, nil
+	}
+	if err != nil {
+		return "", &exitError{4, fmt.Errorf("failed to fetch secret: %w", err)}
+	}
+	if ttl > 0 {
+		if err := cache.put(cfg.CentralMcpServerUrl, name, val, etag, ttl); err != nil {
+			fmt.Fprintln(stderr, "warning: failed to cache secret:", err)
+		}
+	}
+	knownSecrets.add(val)
+	return val, nil
+}
+
+// envFlag collects repeated -env NAME=secret mappings.
+type envFlag map[string]string
+
+func (e envFlag) String() string { return "" }
+
+func (e envFlag) Set(v string) error {
+	k, name, ok := strings.Cut(v, "=")
+	if !ok || k == "" || name == "" {
+		return errors.New("want NAME=secret")
+	}
+	e[k] = name
+	return nil
+}
+
+// resolveEnv fetches every mapped secret, returning NAME=value pairs in a
+// stable order. A mapping of the form PREFIX*=secret expands a map secret
+// (a JSON object) into one PREFIX<FIELD> variable per field.
+func resolveEnv(f *fetcher, mapping map[string]string) ([]string, error) {
+	keys := make([]string, 0, len(mapping))
+	for k := range mapping {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	env := make([]string, 0, len(keys))
+	for _, k := range keys {
+		v, err := f.get(mapping[k])
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", k, err)
+		}
+		if prefix, ok := strings.CutSuffix(k, "*"); ok {
+			fields, err := secretFields(v)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", k, err)
+			}
+			for _, kv := range fields {
+				env = append(env, prefix+kv)
+			}
+			continue
+		}
+		env = append(env, k+"="+v)
+	}
+	return env, nil
+}
+
+// secretFields splits a map secret into FIELD=value pairs sorted by field.
+// String fields are used as is; other values are rendered as JSON.
+func secretFields(v string) ([]string, error) {
+	var m map[string]any
+	if err := decodeJSON([]byte(v), &m); err != nil {
+		return nil, errors.New("secret is not a JSON object of fields")
+	}
+	out := make([]string, 0, len(m))
+	for k, fv := range m {
+		s, ok := fv.(string)
+		if !ok {
+			b, err := json.Marshal(fv)
+			if err != nil {
+				return nil, err
+			}
+			s = string(b)
+		}
+		knownSecrets.add(s)
+		out = append(out, k+"="+s)
+	}
+	sort.Strings(out)
+	return out, nil
+}
+
+// scrubEnv drops variables whose names match any of the glob patterns.
+func scrubEnv(env, patterns []string) []string {
+	out := env[:0:0]
+	for _, kv := range env {
+		k, _, _ := strings.Cut(kv, "=")
+		drop := false
+		for _, p := range patterns {
+			if ok, _ := path.Match(p, k); ok {
+				drop = true
+				break
+			}
+		}
+		if !drop {
+			out = append(out, kv)
+		}
+	}
+	return out
+}
+
+var execSignals = map[string]os.Signal{
+	"HUP":  syscall.SIGHUP,
+	"INT":  syscall.SIGINT,
+	"QUIT": syscall.SIGQUIT,
+	"TERM": syscall.SIGTERM,
+}
+
+// childExitCode follows the shell convention of 128+signo for a child killed
+// by a signal; ExitCode alone reports -1, which os.Exit turns into 255.
+func childExitCode(ee *exec.ExitError) int {
+	if ws, ok := ee.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+		return 128 + int(ws.Signal())
+	}
+	return ee.ExitCode()
+}
+
+// runExec runs args with the mapped secrets injected into its environment
+// and returns the exit code to propagate. SIGINT/SIGTERM are forwarded to the
+// child. With watch > 0 the secrets are re-fetched on that interval and, when
+// any value changes, the child is restarted (onChange "restart") or sent the
+// named signal (e.g. "HUP").
+//
+// base is the environment the child inherits (already scrubbed if requested).
+func runExec(f *fetcher, mapping map[string]string, base, args []string, watch time.Duration, onChange string) (int, error) {
+	var changeSig os.Signal
+	if onChange != "restart" {
+		sig, ok := execSignals[strings.TrimPrefix(strings.ToUpper(onChange), "SIG")]
+		if !ok {
+			return 2, fmt.Errorf("invalid -on-change %q (want restart, HUP, INT, QUIT or TERM)", onChange)
+		}
+		changeSig = sig
+	}
+	env, err := resolveEnv(f, mapping)
+	if err != nil {
+		return exitCode(err), err
+	}
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sigs)
+
+	var tick <-chan time.Time
+	if watch > 0 {
+		t := time.NewTicker(watch)
+		defer t.Stop()
+		tick = t.C
+	}
+
+	for {
+		cmd := exec.Command(args[0], args[1:]...)
+		cmd.Env = append(base[:len(base):len(base)], env...)
+		cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+		if err := cmd.Start(); err != nil {
+			return 127, err
+		}
+		done := make(chan error, 1)
+		go func() { done <- cmd.Wait() }()
+
+		restart := false
+		for !restart {
+			select {
+			case sig := <-sigs:
+				cmd.Process.Signal(sig)
+			case err := <-done:
+				var ee *exec.ExitError
+				if errors.As(err, &ee) {
+					return childExitCode(ee), nil
+				}
+				if err != nil {
+					return 1, err
+				}
+				return 0, nil
+			case <-tick:
+				next, err := resolveEnv(f, mapping)
+				if err != nil {
+					fmt.Fprintln(stderr, "warning: failed to refresh secrets:", err)
+					continue
+				}
+				if strings.Join(next, "\x00") == strings.Join(env, "\x00") {
+					continue
+				}
+				env = next
+				if changeSig != nil {
+					cmd.Process.Signal(changeSig)
+					continue
+				}
+				fmt.Fprintln(stderr, "secrets changed; restarting", args[0])
+				cmd.Process.Signal(syscall.SIGTERM)
+				select {
+				case <-done:
+				case <-time.After(10 * time.Second):
+					cmd.Process.Kill()
+					<-done
+				}
+				restart = true
+			}
+		}
+	}
+}
+
+// writeCredentials writes each mapped secret to dir/ID (mode 0400) for
+// systemd's LoadCredential=ID:dir/ID, so services read them from
+// $CREDENTIALS_DIRECTORY. An unmapped ID is used as the secret name.
+func writeCredentials(f *fetcher, dir string, mapping map[string]string) error {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return err
+	}
+	for _, id := range slices.Sorted(maps.Keys(mapping)) {
+		if !filepath.IsLocal(id) || strings.ContainsRune(id, '/') {
+			return &exitError{2, fmt.Errorf("invalid credential ID %q", id)}
+		}
+		v, err := f.get(mapping[id])
+		if err != nil {
+			return fmt.Errorf("%s: %w", id, err)
+		}
+		if err := writeFileAtomic(filepath.Join(dir, id), []byte(v), 0o400); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// serveCredentials answers systemd LoadCredential= requests on a unix
+// socket, so no secret is ever written to disk. systemd connects from an
+// abstract address of the form "\x00<random>/unit/<unit>/<credential ID>" and
+// reads the value until EOF; the ID is looked up in mapping or used as the
+// secret name. Requests are served one at a time.
+func serveCredentials(f *fetcher, path string, mapping map[string]string) error {
+	// only root (systemd) needs to connect
+	ln, err := listenUnix(path)
+	if err != nil {
+		return err
+	}
+	defer ln.Close()
+	fmt.Fprintln(stderr, "serving credentials on", path)
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		serveCredential(f, conn, mapping)
+	}
+}
+
+// listenUnix listens on a unix socket at path that only the owner can connect
+// to. The socket is bound in a fresh 0700 directory, restricted to 0600 and
+// only then renamed into place, so nobody else can connect in between. A stale
+// socket at path is replaced; a live one or any other file is an error rather
+// than being deleted.
+func listenUnix(path string) (net.Listener, error) {
+	if fi, err := os.Lstat(path); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		if c, err := net.Dial("unix", path); err == nil {
+			c.Close()
+			return nil, fmt.Errorf("%s is in use by another process", path)
+		}
+	}
+	// short names keep the temporary path within the sun_path limit
+	dir, err := os.MkdirTemp(filepath.Dir(path), ".cm")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	tmp := filepath.Join(dir, "s")
+	ln, err := net.Listen("unix", tmp)
+	if err != nil {
+		return nil, err
+	}
+	// Close would unlink tmp, which no longer exists after the rename
+	ln.(*net.UnixListener).SetUnlinkOnClose(false)
+	if err = os.Chmod(tmp, 0o600); err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return ln, nil
+}
+
+func serveCredential(f *fetcher, conn net.Conn, mapping map[string]string) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(30 * time.Second))
+	peer := conn.RemoteAddr().String()
+	_, rest, ok := strings.Cut(peer, "/unit/")
+	i := strings.LastIndexByte(rest, '/')
+	if !ok || i <= 0 {
+		fmt.Fprintf(stderr, "credential request from %q is not from systemd; ignored\n", peer)
+		return
+	}
+	unit, id := rest[:i], rest[i+1:]
+	name := id
+	if n, ok := mapping[id]; ok {
+		name = n
+	}
+	v, err := f.get(name)
+	if err != nil {
+		// closing without data fails the unit's start, which is what we want
+		fmt.Fprintf(stderr, "credential %s for %s: %v\n", id, unit, err)
+		return
+	}
+	if _, err := io.WriteString(conn, v); err != nil {
+		fmt.Fprintf(stderr, "credential %s for %s: %v\n", id, unit, err)
+		return
+	}
+	fmt.Fprintf(stderr, "served credential %s to %s\n", id, unit)
+}
+
+// serveDockerSecrets implements the Docker secret driver plugin protocol
+// (implements "secretprovider") on a unix socket, normally under
+// /run/docker/plugins. The secret name is taken from the central-mcp.name
+// label, falling back to the Docker secret name. Concurrent lookups of the
+// same secret share one upstream fetch.
+func serveDockerSecrets(f *fetcher, path string) error {
+	mux := http.NewServeMux()
+	reply := func(w http.ResponseWriter, v any) {
+		w.Header().Set("Content-Type", "application/vnd.docker.plugins.v1+json")
+		json.NewEncoder(w).Encode(v)
+	}
+	mux.HandleFunc("POST /Plugin.Activate", func(w http.ResponseWriter, r *http.Request) {
+		reply(w, map[string][]string{"Implements": {"secretprovider"}})
+	})
+	mux.HandleFunc("POST /SecretProvider.GetSecret", func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			SecretName   string
+			SecretLabels map[string]string
+			ServiceName  string
+		}
+		var resp struct {
+			Value      []byte `json:",omitempty"`
+			Err        string `json:",omitempty"`
+			DoNotReuse bool
+		}
+		if err := json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&req); err != nil {
+			resp.Err = "invalid request: " + err.Error()
+			reply(w, resp)
+			return
+		}
+		name := req.SecretName
+		if n := req.SecretLabels["central-mcp.name"]; n != "" {
+			name = n
+		}
+		v, err := f.get(name)
+		if err != nil {
+			resp.Err = err.Error()
+			fmt.Fprintf(stderr, "secret %s for %s: %v\n", name, req.ServiceName, err)
+		} else {
+			resp.Value = []byte(v)
+			// fetch again for every task so rotations reach new containers
+			resp.DoNotReuse = true
+		}
+		reply(w, resp)
+	})
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	ln, err := listenUnix(path)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(stderr, "serving docker secret plugin on", path)
+	return http.Serve(ln, mux)
+}
+
+// readyBackoff is the first delay between -wait-ready attempts.
+var readyBackoff = time.Second
+
+// waitReady blocks until the server's /health answers 200 and every named
+// secret can be fetched, retrying with backoff until timeout. Errors waiting
+// cannot fix (usage errors, rejected names, 401/403) are returned at once.
+func waitReady(f *fetcher, names []string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	delay := readyBackoff
+	for {
+		err := checkReady(f, names)
+		if err == nil {
+			return nil
+		}
+		if !transient(err) {
+			return err
+		}
+		if time.Now().Add(delay).After(deadline) {
+			return fmt.Errorf("not ready after %s: %w", timeout, err)
+		}
+		fmt.Fprintf(stderr, "not ready: %v; retrying in %s\n", err, delay)
+		time.Sleep(delay)
+		if delay *= 2; delay > 10*time.Second {
+			delay = 10 * time.Second
+		}
+	}
+}
+
+// transient reports whether err may clear up on its own: the server being
+// unreachable, a 5xx, or a 404 from a deployment that is still starting.
+func transient(err error) bool {
+	if exitCode(err) == 2 {
+		return false
+	}
+	var se *statusError
+	if errors.As(err, &se) {
+		return se.Code == http.StatusNotFound || se.Code >= 500
+	}
+	var he *httpError
+	if errors.As(err, &he) {
+		return he.Code == http.StatusNotFound || he.Code >= 500
+	}
+	var cv *tls.CertificateVerificationError
+	if errors.As(err, &cv) {
+		return false
+	}
+	var ue *url.Error
+	return errors.As(err, &ue)
+}
+
+func checkReady(f *fetcher, names []string) error {
+	if _, err := ping(f.client, f.cfg.CentralMcpServerUrl); err != nil {
+		return err
+	}
+	for _, n := range names {
+		if _, err := f.get(n); err != nil {
+			return fmt.Errorf("%s: %w", n, err)
+		}
+	}
+	return nil
+}
+
+// RegistryFile declares the MCP servers the central registry should hold.
+type RegistryFile struct {
+	Servers []RegistryServer `json:"servers"`
+	// Policies is refused: the server has no policy API to apply it to.
+	Policies json.RawMessage `json:"policies"`
+}
+
+// RegistryServer mirrors an entry of GET /mcp/servers. Servers are matched by
+// name; the id is assigned by the server.
+type RegistryServer struct {
+	ID           string         `json:"id,omitempty"`
+	Name         string         `json:"name"`
+	URL          string         `json:"url"`
+	Description  string         `json:"description"`
+	Capabilities []string       `json:"capabilities"`
+	Metadata     map[string]any `json:"metadata"`
+}
+
+// registryChange is one step needed to make the live registry match the file.
+type registryChange struct {
+	Action  string // "add", "remove", "update" (metadata only) or "replace"
+	Name    string
+	Desired *RegistryServer
+	Live    *RegistryServer
+}
+
+func (c registryChange) String() string {
+	switch c.Action {
+	case "add":
+		return fmt.Sprintf("+ %s (%s)", c.Name, c.Desired.URL)
+	case "remove":
+		return fmt.Sprintf("- %s (%s)", c.Name, c.Live.URL)
+	case "update":
+		return fmt.Sprintf("~ %s (%s) metadata", c.Name, c.Desired.URL)
+	}
+	return fmt.Sprintf("~ %s (%s)", c.Name, c.Desired.URL)
+}
+
+// loadRegistryFile reads a registry file in JSON or, for .yaml/.yml files
+// that are not plain JSON, in the block YAML subset parseYAML accepts.
+func loadRegistryFile(p string) (*RegistryFile, error) {
+	b, err := os.ReadFile(p)
+	if err != nil {
+		return nil, err
+	}
+	if ext := strings.ToLower(filepath.Ext(p)); (ext == ".yaml" || ext == ".yml") && !json.Valid(b) {
+		v, err := parseYAML(b)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %w", p, err)
+		}
+		if b, err = json.Marshal(v); err != nil {
+			return nil, err
+		}
+	}
+	var rf RegistryFile
+	if err := decodeJSON(b, &rf); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", p, err)
+	}
+	if len(rf.Policies) > 0 && string(rf.Policies) != "null" {
+		return nil, fmt.Errorf("%s: policies are not supported; the server has no policy API", p)
+	}
+	seen := map[string]bool{}
+	for i, srv := range rf.Servers {
+		if srv.Name == "" || srv.URL == "" {
+			return nil, fmt.Errorf("%s: servers[%d] needs name and url", p, i)
+		}
+		if seen[srv.Name] {
+			return nil, fmt.Errorf("%s: duplicate server name %q", p, srv.Name)
+		}
+		seen[srv.Name] = true
+	}
+	return &rf, nil
+}
+
+// yamlLine is one non-blank, comment-stripped line of a YAML document.
+type yamlLine struct {
+	n      int // 1-based line number, for errors
+	indent int
+	text   string
+}
+
+// parseYAML decodes the block YAML subset registry files need: nested
+// mappings and sequences, "- key: value" items, flow lists and maps of
+// scalars, quoted and plain scalars, and comments. Anchors, tags, multi-line
+// scalars and multiple documents are refused rather than misread. Mappings
+// decode to map[string]any, sequences to []any.
+func parseYAML(b []byte) (any, error) {
+	var lines []yamlLine
+	for i, raw := range strings.Split(string(b), "\n") {
+		raw = strings.TrimRight(raw, " \r")
+		text := strings.TrimLeft(raw, " ")
+		if strings.HasPrefix(text, "\t") {
+			return nil, fmt.Errorf("line %d: tabs are not allowed in indentation", i+1)
+		}
+		indent := len(raw) - len(text)
+		text = strings.TrimRight(stripYAMLComment(text), " ")
+		if text == "" || (text == "---" && len(lines) == 0) {
+			continue
+		}
+		if text == "---" || text == "..." {
+			return nil, fmt.Errorf("line %d: multiple documents are not supported", i+1)
+		}
+		lines = append(lines, yamlLine{n: i + 1, indent: indent, text: text})
+	}
+	if len(lines) == 0 {
+		return nil, nil
+	}
+	p := &yamlParser{lines: lines}
+	v, err := p.node(lines[0].indent)
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(lines) {
+		return nil, fmt.Errorf("line %d: unexpected indentation", lines[p.pos].n)
+	}
+	return v, nil
+}
+
+// stripYAMLComment drops a "#" comment that starts the line or follows a
+// space outside quotes.
+func stripYAMLComment(s string) string {
+	var quote byte
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case quote == '"' && c == '\\':
+			i++
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case (c == '"' || c == '\'') && yamlQuoteOpens(s, i):
+			quote = c
+		case c == '#' && (i == 0 || s[i-1] == ' '):
+			return s[:i]
+		}
+	}
+	return s
+}
+
+// yamlQuoteOpens reports whether a quote at s[i] starts a quoted scalar
+// rather than sitting inside a plain one, as in "it's".
+func yamlQuoteOpens(s string, i int) bool {
+	j := i - 1
+	for j >= 0 && s[j] == ' ' {
+		j--
+	}
+	return j < 0 || strings.IndexByte(":-[{,", s[j]) >= 0
+}
+
+type yamlParser struct {
+	lines []yamlLine
+	pos   int
+}
+
+func isYAMLSeqItem(text string) bool { return text == "-" || strings.HasPrefix(text, "- ") }
+
+// node parses the block starting at the current line, which sits at indent.
+func (p *yamlParser) node(indent int) (any, error) {
+	l := p.lines[p.pos]
+	if isYAMLSeqItem(l.text) {
+		return p.seq(indent)
+	}
+	if _, _, ok := splitYAMLKey(l.text); ok {
+		return p.mapping(indent)
+	}
+	p.pos++
+	return yamlScalar(l.text, l.n)
+}
+
+// child parses the block nested under a "key:" line at parent, or returns
+// nil when nothing is nested. A sequence may sit at the key's own indent
+// ("key:\n- item").
+func (p *yamlParser) child(parent int) (any, error) {
+	if p.pos >= len(p.lines) {
+		return nil, nil
+	}
+	l := p.lines[p.pos]
+	if l.indent > parent || (l.indent == parent && isYAMLSeqItem(l.text)) {
+		return p.node(l.indent)
+	}
+	return nil, nil
+}
+
+func (p *yamlParser) seq(indent int) (any, error) {
+	out := []any{}
+	for p.pos < len(p.lines) {
+		l := p.lines[p.pos]
+		if l.indent != indent || !isYAMLSeqItem(l.text) {
+			break
+		}
+		rest := strings.TrimLeft(l.text[1:], " ")
+		if rest == "" {
+			p.pos++
+			var v any
+			if p.pos < len(p.lines) && p.lines[p.pos].indent > indent {
+				var err error
+				if v, err = p.node(p.lines[p.pos].indent); err != nil {
+					return nil, err
+				}
+			}
+			out = append(out, v)
+			continue
+		}
+		// "- key: value" opens a mapping at the column after the dash
+		col := indent + len(l.text) - len(rest)
+		p.lines[p.pos] = yamlLine{n: l.n, indent: col, text: rest}
+		v, err := p.node(col)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, v)
+	}
+	return out, nil
+}
+
+func (p *yamlParser) mapping(indent int) (any, error) {
+	out := map[string]any{}
+	for p.pos < len(p.lines) {
+		l := p.lines[p.pos]
+		if l.indent < indent || (l.indent == indent && isYAMLSeqItem(l.text)) {
+			break
+		}
+		if l.indent > indent {
+			return nil, fmt.Errorf("line %d: unexpected indentation", l.n)
+		}
+		rawKey, rest, ok := splitYAMLKey(l.text)
+		if !ok {
+			return nil, fmt.Errorf("line %d: expected \"key: value\"", l.n)
+		}
+		k, err := yamlScalar(rawKey, l.n)
+		if err != nil {
+			return nil, err
+		}
+		key, ok := k.(string)
+		if !ok {
+			key = rawKey
+		}
+		if _, dup := out[key]; dup {
+			return nil, fmt.Errorf("line %d: duplicate key %q", l.n, key)
+		}
+		p.pos++
+		var v any
+		if rest == "" {
+			v, err = p.child(indent)
+		} else {
+			v, err = yamlScalar(rest, l.n)
+		}
+		if err != nil {
+			return nil, err
+		}
+		out[key] = v
+	}
+	return out, nil
+}
+
+// splitYAMLKey splits "key: value" at the first ": " (or trailing ":")
+// outside quotes.
+func splitYAMLKey(s string) (key, rest string, ok bool) {
+	var quote byte
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case quote == '"' && c == '\\':
+			i++
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case (c == '"' || c == '\'') && i == 0:
+			quote = c
+		case c == ':' && (i == len(s)-1 || s[i+1] == ' '):
+			return strings.TrimSpace(s[:i]), strings.TrimSpace(s[i+1:]), i > 0
+		}
+	}
+	return "", "", false
+}
+
+var yamlNumber = regexp.MustCompile(`^[-+]?(0|[1-9][0-9]*)(\.[0-9]+)?([eE][-+]?[0-9]+)?$`)
+
+// yamlScalar decodes a single-line value: a quoted or plain scalar, or a
+// flow list or map of scalars.
+func yamlScalar(s string, n int) (any, error) {
+	switch {
+	case s == "":
+		return nil, nil
+	case strings.HasPrefix(s, `"`):
+		v, err := strconv.Unquote(s)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid double-quoted string %s", n, s)
+		}
+		return v, nil
+	case strings.HasPrefix(s, "'"):
+		if len(s) < 2 || !strings.HasSuffix(s, "'") {
+			return nil, fmt.Errorf("line %d: unterminated single-quoted string", n)
+		}
+		return strings.ReplaceAll(s[1:len(s)-1], "''", "'"), nil
+	case strings.HasPrefix(s, "["), strings.HasPrefix(s, "{"):
+		return yamlFlow(s, n)
+	case strings.ContainsAny(s[:1], "&*!|>%@`"):
+		return nil, fmt.Errorf("line %d: unsupported YAML construct %q", n, s)
+	}
+	switch s {
+	case "null", "Null", "NULL", "~":
+		return nil, nil
+	case "true", "True", "TRUE":
+		return true, nil
+	case "false", "False", "FALSE":
+		return false, nil
+	}
+	if yamlNumber.MatchString(s) {
+		return json.Number(s), nil
+	}
+	return s, nil
+}
+
+// yamlFlow decodes a one-line flow collection whose items are scalars.
+func yamlFlow(s string, n int) (any, error) {
+	open, end := s[0], map[byte]byte{'[': ']', '{': '}'}[s[0]]
+	if s[len(s)-1] != end {
+		return nil, fmt.Errorf("line %d: unterminated flow collection %s", n, s)
+	}
+	var items []string
+	var quote byte
+	start := 1
+	for i := 1; i < len(s)-1; i++ {
+		switch c := s[i]; {
+		case quote == '"' && c == '\\':
+			i++
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case (c == '"' || c == '\'') && yamlQuoteOpens(s, i):
+			quote = c
+		case c == '[' || c == '{':
+			return nil, fmt.Errorf("line %d: nested flow collections are not supported", n)
+		case c == ',':
+			items = append(items, strings.TrimSpace(s[start:i]))
+			start = i + 1
+		}
+	}
+	if last := strings.TrimSpace(s[start : len(s)-1]); last != "" || len(items) > 0 {
+		items = append(items, last)
+	}
+	if open == '[' {
+		out := []any{}
+		for _, it := range items {
+			v, err := yamlScalar(it, n)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, v)
+		}
+		return out, nil
+	}
+	out := map[string]any{}
+	for _, it := range items {
+		k, rest, ok := splitYAMLKey(it)
+		if !ok {
+			return nil, fmt.Errorf("line %d: expected \"key: value\" in %s", n, s)
+		}
+		if kv, err := yamlScalar(k, n); err == nil {
+			if ks, isStr := kv.(string); isStr {
+				k = ks
+			}
+		}
+		v, err := yamlScalar(rest, n)
+		if err != nil {
+			return nil, err
+		}
+		out[k] = v
+	}
+	return out, nil
+}
+
+// sameServer compares the declared fields of two registry entries.
+func sameServer(a, b *RegistryServer) bool {
+	return sameServerFields(a, b) && sameMetadata(a.Metadata, b.Metadata)
+}
+
+// sameServerFields compares everything but the metadata.
+func sameServerFields(a, b *RegistryServer) bool {
+	if a.URL != b.URL || a.Description != b.Description {
+		return false
+	}
+	ac := append([]string(nil), a.Capabilities...)
+	bc := append([]string(nil), b.Capabilities...)
+	sort.Strings(ac)
+	sort.Strings(bc)
+	return strings.Join(ac, "\x00") == strings.Join(bc, "\x00")
+}
+
+func sameMetadata(a, b map[string]any) bool {
+	if len(a) == 0 && len(b) == 0 {
+		return true
+	}
+	am, _ := json.Marshal(a)
+	bm, _ := json.Marshal(b)
+	return bytes.Equal(am, bm)
+}
+
+// planRegistry lists the changes turning live into desired. Servers only
+// present live are removals, reported only when prune is set. When several
+// live servers share a declared name, one is kept (preferably an exact
+// match) and the rest are removed, since the file declares exactly one.
+// Metadata-only changes are updates in place, unless they drop a key: the
+// metadata PATCH merges, so that needs a replace.
+func planRegistry(desired *RegistryFile, live []RegistryServer, prune bool) []registryChange {
+	byName := map[string][]*RegistryServer{}
+	for i := range live {
+		byName[live[i].Name] = append(byName[live[i].Name], &live[i])
+	}
+	var changes []registryChange
+	want := map[string]bool{}
+	for i := range desired.Servers {
+		d := &desired.Servers[i]
+		want[d.Name] = true
+		group := byName[d.Name]
+		if len(group) == 0 {
+			changes = append(changes, registryChange{Action: "add", Name: d.Name, Desired: d})
+			continue
+		}
+		keep := 0
+		for j, l := range group {
+			if sameServer(d, l) {
+				keep = j
+				break
+			}
+		}
+		for j, l := range group {
+			if j != keep {
+				changes = append(changes, registryChange{Action: "remove", Name: d.Name, Live: l})
+			}
+		}
+		l := group[keep]
+		switch {
+		case sameServer(d, l):
+		case sameServerFields(d, l) && !dropsMetadataKey(d.Metadata, l.Metadata):
+			changes = append(changes, registryChange{Action: "update", Name: d.Name, Desired: d, Live: l})
+		default:
+			changes = append(changes, registryChange{Action: "replace", Name: d.Name, Desired: d, Live: l})
+		}
+	}
+	if prune {
+		for i := range live {
+			if !want[live[i].Name] {
+				changes = append(changes, registryChange{Action: "remove", Name: live[i].Name, Live: &live[i]})
+			}
+		}
+	}
+	return changes
+}
+
+// dropsMetadataKey reports whether live metadata has a key desired lacks.
+func dropsMetadataKey(desired, live map[string]any) bool {
+	for k := range live {
+		if _, ok := desired[k]; !ok {
+			return true
+		}
+	}
+	return false
+}
+
+// doJSON sends an optional JSON body and decodes an optional JSON answer.
+func doJSON(client *http.Client, auth func(*http.Request, []byte) error, method, u string, in, out any) error {
+	var body []byte
+	if in != nil {
+		var err error
+		if body, err = json.Marshal(in); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequest(method, u, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if auth != nil {
+		if err := auth(req, body); err != nil {
+			return err
+		}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s %s failed %d: %s", method, req.URL.Path, resp.StatusCode, snippet(b))
+	}
+	if out != nil {
+		return decodeJSON(b, out)
+	}
+	return nil
+}
+
+func liveRegistry(client *http.Client, serverURL string) ([]RegistryServer, error) {
+	var out struct {
+		Servers []RegistryServer `json:"servers"`
+	}
+	if err := doJSON(client, nil, "GET", apiBase(serverURL)+"/mcp/servers", nil, &out); err != nil {
+		return nil, err
+	}
+	return out.Servers, nil
+}
+
+// planRegistryFile reports drift between the file and the live registry
+// without changing anything. Live servers missing from the file count as
+// drift. It returns whether any drift was found.
+func planRegistryFile(client *http.Client, serverURL, path string) (bool, error) {
+	desired, err := loadRegistryFile(path)
+	if err != nil {
+		return false, err
+	}
+	live, err := liveRegistry(client, serverURL)
+	if err != nil {
+		return false, err
+	}
+	changes := planRegistry(desired, live, true)
+	for _, c := range changes {
+		fmt.Println(c)
+	}
+	if len(changes) == 0 {
+		fmt.Println("no drift")
+		return false, nil
+	}
+	fmt.Printf("%d change(s) needed\n", len(changes))
+	return true, nil
+}
+
+// applyRegistry makes the live registry match the file. Metadata changes
+// are patched in place; the registry API has no other update call, so any
+// other change unregisters the server and registers it again.
+func applyRegistry(f *fetcher, path string, prune bool) error {
+	desired, err := loadRegistryFile(path)
+	if err != nil {
+		return err
+	}
+	base := apiBase(f.cfg.CentralMcpServerUrl)
+	live, err := liveRegistry(f.client, f.cfg.CentralMcpServerUrl)
+	if err != nil {
+		return err
+	}
+	changes := planRegistry(desired, live, prune)
+	if len(changes) == 0 {
+		fmt.Println("registry up to date")
+		return nil
+	}
+	if err := f.authorize(); err != nil {
+		return err
+	}
+	for _, c := range changes {
+		fmt.Println(c)
+		if c.Action == "update" {
+			if err := doJSON(f.client, f.auth, "PATCH", base+"/mcp/servers/"+url.PathEscape(c.Live.ID)+"/metadata", c.Desired.Metadata, nil); err != nil {
+				return err
+			}
+			continue
+		}
+		if c.Live != nil {
+			if err := doJSON(f.client, f.auth, "DELETE", base+"/mcp/servers/"+url.PathEscape(c.Live.ID), nil, nil); err != nil {
+				return err
+			}
+		}
+		if c.Desired != nil {
+			d := *c.Desired
+			d.ID = ""
+			if err := doJSON(f.client, f.auth, "POST", base+"/mcp/servers", d, nil); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// DBCredential is the structured secret type for database credentials,
+// stored as JSON.
+type DBCredential struct {
+	Host     string            `json:"host"`
+	Port     int               `json:"port"`
+	User     string            `json:"user"`
+	Password string            `json:"password"`
+	Database string            `json:"database"`
+	Options  map[string]string `json:"options"`
+}
+
+var defaultDBPorts = map[string]int{"postgres": 5432, "mysql": 3306, "sqlserver": 1433, "mongodb": 27017}
+
+// buildDSN renders a DB credential secret as a driver-specific connection
+// string so apps stop concatenating credentials themselves. URL-style DSNs
+// are escaped; the mysql format takes the password verbatim.
+func buildDSN(driver, secret string) (string, error) {
+	var c DBCredential
+	if err := decodeJSON([]byte(secret), &c); err != nil {
+		return "", fmt.Errorf("secret is not a DB credential JSON object: %w", err)
+	}
+	if c.Host == "" {
+		return "", errors.New("DB credential has no host")
+	}
+	def, ok := defaultDBPorts[driver]
+	if !ok {
+		return "", fmt.Errorf("unsupported driver %q (want postgres, mysql, sqlserver or mongodb)", driver)
+	}
+	if c.Port == 0 {
+		c.Port = def
+	}
+	hostport := net.JoinHostPort(c.Host, strconv.Itoa(c.Port))
+	q := url.Values{}
+	for k, v := range c.Options {
+		q.Set(k, v)
+	}
+	switch driver {
+	case "mysql":
+		// go-sql-driver/mysql format: user:pass@tcp(host:port)/db?opts
+		dsn := c.User
+		if c.Password != "" {
+			dsn += ":" + c.Password
+		}
+		dsn += "@tcp(" + hostport + ")/" + c.Database
+		if len(q) > 0 {
+			dsn += "?" + q.Encode()
+		}
+		return dsn, nil
+	case "sqlserver":
+		if c.Database != "" {
+			q.Set("database", c.Database)
+		}
+		u := url.URL{Scheme: "sqlserver", User: url.UserPassword(c.User, c.Password), Host: hostport, RawQuery: q.Encode()}
+		return u.String(), nil
+	}
+	u := url.URL{Scheme: driver, Host: hostport, Path: "/" + c.Database, RawQuery: q.Encode()}
+	if c.User != "" {
+		u.User = url.UserPassword(c.User, c.Password)
+	}
+	return u.String(), nil
+}
+
+// RegistryCredential is the structured secret type for package registry
+// access, stored as JSON. Token is preferred over username/password where the
+// format supports it.
+type RegistryCredential struct {
+	URL      string `json:"url"`
+	Token    string `json:"token"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+	// Scope is an npm scope such as "@myorg".
+	Scope string `json:"scope"`
+	// ID is the Maven server id referenced from repositories in the pom.
+	ID string `json:"id"`
+}
+
+// registryConfig renders a registry credential as an .npmrc, pip.conf or
+// Maven settings.xml <server> fragment.
+func registryConfig(kind, secret string) (string, error) {
+	var c RegistryCredential
+	if err := decodeJSON([]byte(secret), &c); err != nil {
+		return "", fmt.Errorf("secret is not a registry credential JSON object: %w", err)
+	}
+	switch kind {
+	case "npmrc":
+		u, err := url.Parse(c.URL)
+		if err != nil || u.Host == "" {
+			return "", fmt.Errorf("invalid registry url %q", c.URL)
+		}
+		// auth lines are keyed by the registry URL without scheme
+		key := "//" + u.Host + strings.TrimSuffix(u.Path, "/") + "/:"
+		var b strings.Builder
+		if c.Scope != "" {
+			fmt.Fprintf(&b, "%s:registry=%s\n", c.Scope, c.URL)
+		} else {
+			fmt.Fprintf(&b, "registry=%s\n", c.URL)
+		}
+		if c.Token != "" {
+			fmt.Fprintf(&b, "%s_authToken=%s\n", key, c.Token)
+		} else {
+			fmt.Fprintf(&b, "%s_auth=%s\n", key, base64.StdEncoding.EncodeToString([]byte(c.Username+":"+c.Password)))
+		}
+		b.WriteString(key + "always-auth=true\n")
+		return b.String(), nil
+	case "pip":
+		u, err := url.Parse(c.URL)
+		if err != nil || u.Host == "" {
+			return "", fmt.Errorf("invalid registry url %q", c.URL)
+		}
+		switch {
+		case c.Username != "":
+			u.User = url.UserPassword(c.Username, c.Password)
+		case c.Token != "":
+			u.User = url.UserPassword("__token__", c.Token)
+		}
+		return "[global]\nindex-url = " + u.String() + "\n", nil
+	case "maven":
+		if c.ID == "" {
+			return "", errors.New("maven credentials need an id")
+		}
+		user, pass := c.Username, c.Password
+		if pass == "" {
+			pass = c.Token
+		}
+		var b bytes.Buffer
+		b.WriteString("<server>\n  <id>")
+		xml.EscapeText(&b, []byte(c.ID))
+		b.WriteString("</id>\n  <username>")
+		xml.EscapeText(&b, []byte(user))
+		b.WriteString("</username>\n  <password>")
+		xml.EscapeText(&b, []byte(pass))
+		b.WriteString("</password>\n</server>\n")
+		return b.String(), nil
+	}
+	return "", fmt.Errorf("unknown registry config %q", kind)
+}
+
+// formatSecret renders a fetched value in the requested -format.
+func formatSecret(format, driver, val string) (string, error) {
+	switch format {
+	case "", "raw":
+		return val, nil
+	case "dsn":
+		if driver == "" {
+			return "", errors.New("-format dsn needs -driver")
+		}
+		return buildDSN(driver, val)
+	case "npmrc", "pip", "maven":
+		return registryConfig(format, val)
+	}
+	return "", fmt.Errorf("unknown -format %q", format)
+}
+
+// writeCloudCredentials installs a fetched cloud credential in the standard
+// location for its provider and returns the path written:
+//   - aws: JSON {accessKeyId, secretAccessKey, sessionToken} merged as a
+//     profile section into $AWS_SHARED_CREDENTIALS_FILE or ~/.aws/credentials
+//   - gcp: a service account JSON written to $GOOGLE_APPLICATION_CREDENTIALS
+//     or the gcloud application default credentials path
+//   - azure: an SDK auth file JSON written to $AZURE_AUTH_LOCATION or
+//     ~/.azure/central-mcp-auth.json
+func writeCloudCredentials(provider, profile, val string) (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	var dst string
+	var out []byte
+	switch provider {
+	case "aws":
+		var c struct {
+			AccessKeyID     string `json:"accessKeyId"`
+			SecretAccessKey string `json:"secretAccessKey"`
+			SessionToken    string `json:"sessionToken"`
+		}
+		if err := decodeJSON([]byte(val), &c); err != nil || c.AccessKeyID == "" || c.SecretAccessKey == "" {
+			return "", errors.New("aws secret must be JSON with accessKeyId and secretAccessKey")
+		}
+		if dst = os.Getenv("AWS_SHARED_CREDENTIALS_FILE"); dst == "" {
+			dst = filepath.Join(home, ".aws", "credentials")
+		}
+		section := []string{"aws_access_key_id = " + c.AccessKeyID, "aws_secret_access_key = " + c.SecretAccessKey}
+		if c.SessionToken != "" {
+			section = append(section, "aws_session_token = "+c.SessionToken)
+		}
+		old, _ := os.ReadFile(dst)
+		out = []byte(setINISection(string(old), profile, section))
+	case "gcp":
+		if decodeJSON([]byte(val), new(json.RawMessage)) != nil {
+			return "", errors.New("gcp secret must be a service account JSON document")
+		}
+		if dst = os.Getenv("GOOGLE_APPLICATION_CREDENTIALS"); dst == "" {
+			dst = filepath.Join(gcloudConfigDir(home), "application_default_credentials.json")
+		}
+		out = []byte(val)
+	case "azure":
+		if decodeJSON([]byte(val), new(json.RawMessage)) != nil {
+			return "", errors.New("azure secret must be an SDK auth file JSON document")
+		}
+		if dst = os.Getenv("AZURE_AUTH_LOCATION"); dst == "" {
+			dst = filepath.Join(home, ".azure", "central-mcp-auth.json")
+		}
+		out = []byte(val)
+	default:
+		return "", fmt.Errorf("unknown cloud provider %q (want aws, gcp or azure)", provider)
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0o700); err != nil {
+		return "", err
+	}
+	return dst, writeFileAtomic(dst, out, 0o600)
+}
+
+// gcloudConfigDir is where the gcloud SDK looks for its config:
+// $CLOUDSDK_CONFIG, else %APPDATA%\gcloud on Windows and ~/.config/gcloud
+// elsewhere (gcloud ignores XDG_CONFIG_HOME and uses ~/.config on macOS too).
+func gcloudConfigDir(home string) string {
+	if dir := os.Getenv("CLOUDSDK_CONFIG"); dir != "" {
+		return dir
+	}
+	if runtime.GOOS == "windows" {
+		if dir := os.Getenv("APPDATA"); dir != "" {
+			return filepath.Join(dir, "gcloud")
+		}
+	}
+	return filepath.Join(home, ".config", "gcloud")
+}
+
+// setINISection replaces (or appends) the [name] section of an INI file,
+// leaving other sections untouched. Keys are not merged: the section is
+// rewritten as lines.
+func setINISection(ini, name string, lines []string) string {
+	var out []string
+	in, done := false, false
+	for _, l := range strings.Split(strings.TrimRight(ini, "\n"), "\n") {
+		t := strings.TrimSpace(l)
+		if strings.HasPrefix(t, "[") && strings.HasSuffix(t, "]") {
+			in = strings.TrimSpace(t[1:len(t)-1]) == name
+			if in {
+				// a repeated [name] is dropped, not written twice
+				if !done {
+					out = append(out, "["+name+"]")
+					out = append(out, lines...)
+				}
+				done = true
+				continue
+			}
+			if len(out) > 0 && out[len(out)-1] != "" {
+				out = append(out, "")
+			}
+		}
+		if !in && (l != "" || len(out) > 0) {
+			out = append(out, l)
+		}
+	}
+	if !done {
+		if len(out) > 0 {
+			out = append(out, "")
+		}
+		out = append(out, "["+name+"]")
+		out = append(out, lines...)
+	}
+	return strings.Join(out, "\n") + "\n"
+}
+
+// Kubernetes cluster credentials are stored under kubernetes/<cluster>/:
+// "server" (API endpoint URL), "ca" (PEM CA bundle) and "token".
+func kubeSecret(cluster, item string) string {
+	return "kubernetes/" + cluster + "/" + item
+}
+
+// buildKubeconfig assembles a kubeconfig (JSON, which kubectl accepts) for a
+// stored cluster. With useExec the user entry runs this binary as an exec
+// credential plugin instead of embedding the token.
+func buildKubeconfig(f *fetcher, cluster string, useExec bool) ([]byte, error) {
+	server, err := f.get(kubeSecret(cluster, "server"))
+	if err != nil {
+		return nil, err
+	}
+	ca, err := f.get(kubeSecret(cluster, "ca"))
+	if err != nil {
+		return nil, err
+	}
+	user := map[string]any{}
+	if useExec {
+		self, err := os.Executable()
+		if err != nil {
+			return nil, err
+		}
+		user["exec"] = map[string]any{
+			"apiVersion":      "client.authentication.k8s.io/v1",
+			"command":         self,
+			"args":            []string{"-k8s-exec-credential", cluster},
+			"interactiveMode": "Never",
+		}
+	} else {
+		token, err := f.get(kubeSecret(cluster, "token"))
+		if err != nil {
+			return nil, err
+		}
+		user["token"] = token
+	}
+	kc := map[string]any{
+		"apiVersion": "v1",
+		"kind":       "Config",
+		"clusters": []any{map[string]any{"name": cluster, "cluster": map[string]any{
+			"server":                     server,
+			"certificate-authority-data": base64.StdEncoding.EncodeToString([]byte(ca)),
+		}}},
+		"users": []any{map[string]any{"name": cluster, "user": user}},
+		"contexts": []any{map[string]any{"name": cluster, "context": map[string]any{
+			"cluster": cluster,
+			"user":    cluster,
+		}}},
+		"current-context": cluster,
+	}
+	return json.MarshalIndent(kc, "", "  ")
+}
+
+// execCredential renders an ExecCredential carrying the cluster's stored
+// token, for kubectl's exec plugin protocol. The apiVersion follows the one
+// kubectl announces in KUBERNETES_EXEC_INFO, and if the token is a JWT its
+// exp becomes expirationTimestamp so kubectl re-invokes us before expiry.
+func execCredential(f *fetcher, cluster string) ([]byte, error) {
+	apiVersion := "client.authentication.k8s.io/v1"
+	if info := os.Getenv("KUBERNETES_EXEC_INFO"); info != "" {
+		var in struct {
+			APIVersion string `json:"apiVersion"`
+		}
+		if err := decodeJSON([]byte(info), &in); err != nil {
+			return nil, fmt.Errorf("invalid KUBERNETES_EXEC_INFO: %w", err)
+		}
+		if in.APIVersion != "" {
+			apiVersion = in.APIVersion
+		}
+	}
+	token, err := f.get(kubeSecret(cluster, "token"))
+	if err != nil {
+		return nil, err
+	}
+	status := map[string]any{"token": token}
+	if claims, err := jwtClaims(token); err == nil {
+		if exp, ok := claims["exp"].(float64); ok {
+			status["expirationTimestamp"] = time.Unix(int64(exp), 0).UTC().Format(time.RFC3339)
+		}
+	}
+	return json.Marshal(map[string]any{
+		"apiVersion": apiVersion,
+		"kind":       "ExecCredential",
+		"status":     status,
+	})
+}
+
+// totpCode computes the current RFC 6238 code for a stored TOTP seed, given
+// either as a base32 secret or an otpauth://totp/ URI (honouring its digits,
+// period and algorithm parameters).
+func totpCode(seed string, now time.Time) (string, error) {
+	secret, digits, period, algo := strings.TrimSpace(seed), 6, 30, "SHA1"
+	if strings.HasPrefix(secret, "otpauth://") {
+		u, err := url.Parse(secret)
+		if err != nil {
+			return "", fmt.Errorf("invalid otpauth URI: %w", err)
+		}
+		if u.Host != "totp" {
+			return "", fmt.Errorf("unsupported otpauth type %q", u.Host)
+		}
+		q := u.Query()
+		secret = q.Get("secret")
+		if v := q.Get("digits"); v != "" {
+			if digits, err = strconv.Atoi(v); err != nil || digits < 6 || digits > 10 {
+				return "", fmt.Errorf("invalid digits %q", v)
+			}
+		}
+		if v := q.Get("period"); v != "" {
+			if period, err = strconv.Atoi(v); err != nil || period <= 0 {
+				return "", fmt.Errorf("invalid period %q", v)
+			}
+		}
+		if v := q.Get("algorithm"); v != "" {
+			algo = strings.ToUpper(v)
+		}
+	}
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(strings.ToUpper(strings.TrimRight(strings.ReplaceAll(secret, " ", ""), "=")))
+	if err != nil {
+		return "", fmt.Errorf("invalid base32 TOTP secret: %w", err)
+	}
+	var h func() hash.Hash
+	switch algo {
+	case "SHA1":
+		h = sha1.New
+	case "SHA256":
+		h = sha256.New
+	case "SHA512":
+		h = sha512.New
+	default:
+		return "", fmt.Errorf("unsupported algorithm %q", algo)
+	}
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(now.Unix()/int64(period)))
+	mac := hmac.New(h, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+	off := sum[len(sum)-1] & 0x0f
+	code := binary.BigEndian.Uint32(sum[off:off+4]) & 0x7fffffff
+	mod := uint64(1)
+	for i := 0; i < digits; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", digits, uint64(code)%mod), nil
+}
+
+// templateFuncs is the function library available to -template: secret
+// lookups plus encoding, JSON, PEM and sprig-like string helpers.
+func templateFuncs(f *fetcher) template.FuncMap {
+	return template.FuncMap{
+		"secret": f.get,
+		"secretOr": func(name, def string) (string, error) {
+			v, err := f.get(name)
+			if isNotFound(err) {
+				return def, nil
+			}
+			return v, err
+		},
+		"required": func(msg string, v any) (any, error) {
+			if v == nil || v == "" {
+				return nil, errors.New(msg)
+			}
+			return v, nil
+		},
+		"default": func(def, v any) any {
+			if v == nil || v == "" {
+				return def
+			}
+			return v
+		},
+		"totp": func(name string) (string, error) {
+			seed, err := f.get(name)
+			if err != nil {
+				return "", err
+			}
+			return totpCode(seed, time.Now())
+		},
+		"dsn":       buildDSN,
+		"base64enc": func(s string) string { return base64.StdEncoding.EncodeToString([]byte(s)) },
+		"base64dec": func(s string) (string, error) {
+			b, err := base64.StdEncoding.DecodeString(strings.TrimSpace(s))
+			return string(b), err
+		},
+		"jsonField": jsonField,
+		"toJson": func(v any) (string, error) {
+			b, err := json.Marshal(v)
+			return string(b), err
+		},
+		"pemBlocks":  pemBlocks,
+		"indent":     indent,
+		"nindent":    func(n int, s string) string { return "\n" + indent(n, s) },
+		"upper":      strings.ToUpper,
+		"lower":      strings.ToLower,
+		"trim":       strings.TrimSpace,
+		"trimPrefix": func(prefix, s string) string { return strings.TrimPrefix(s, prefix) },
+		"trimSuffix": func(suffix, s string) string { return strings.TrimSuffix(s, suffix) },
+		"replace":    func(old, new, s string) string { return strings.ReplaceAll(s, old, new) },
+		"contains":   func(sub, s string) bool { return strings.Contains(s, sub) },
+		"hasPrefix":  func(prefix, s string) bool { return strings.HasPrefix(s, prefix) },
+		"hasSuffix":  func(suffix, s string) bool { return strings.HasSuffix(s, suffix) },
+		"splitList":  func(sep, s string) []string { return strings.Split(s, sep) },
+		"join":       func(sep string, list []string) string { return strings.Join(list, sep) },
+		"quote":      strconv.Quote,
+		"squote":     func(s string) string { return "'" + s + "'" },
+	}
+}
+
+// jsonField extracts a dot-separated path ("db.host", "servers.0.url") from a
+// JSON document. Strings are returned as-is, other values as JSON.
+func jsonField(path, doc string) (string, error) {
+	var v any
+	if err := decodeJSON([]byte(doc), &v); err != nil {
+		return "", fmt.Errorf("jsonField: %w", err)
+	}
+	for _, key := range strings.Split(path, ".") {
+		switch node := v.(type) {
+		case map[string]any:
+			next, ok := node[key]
+			if !ok {
+				return "", fmt.Errorf("jsonField: %q not found", path)
+			}
+			v = next
+		case []any:
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(node) {
+				return "", fmt.Errorf("jsonField: bad index %q in %q", key, path)
+			}
+			v = node[i]
+		default:
+			return "", fmt.Errorf("jsonField: %q not found", path)
+		}
+	}
+	if str, ok := v.(string); ok {
+		return str, nil
+	}
+	b, err := json.Marshal(v)
+	return string(b), err
+}
+
+// pemBlocks splits PEM text into its blocks, keeping only those of type typ
+// ("CERTIFICATE", "PRIVATE KEY", ...) unless typ is empty.
+func pemBlocks(typ, text string) []string {
+	var out []string
+	rest := []byte(text)
+	for {
+		var b *pem.Block
+		b, rest = pem.Decode(rest)
+		if b == nil {
+			return out
+		}
+		if typ == "" || b.Type == typ {
+			out = append(out, string(pem.EncodeToMemory(b)))
+		}
+	}
+}
+
+func indent(n int, s string) string {
+	pad := strings.Repeat(" ", n)
+	return pad + strings.ReplaceAll(s, "\n", "\n"+pad)
+}
+
+// renderTemplate renders the template at path ("-" for stdin).
+func renderTemplate(f *fetcher, path string) ([]byte, error) {
+	var src []byte
+	var err error
+	if path == "-" {
+		src, err = io.ReadAll(os.Stdin)
+	} else {
+		src, err = os.ReadFile(path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	tmpl, err := template.New(filepath.Base(path)).Option("missingkey=error").Funcs(templateFuncs(f)).Parse(string(src))
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, nil); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// renderTemplateFile renders the template at path to out, or stdout if out is
+// empty. Files are written with mode 0600 since they hold secret values.
+func renderTemplateFile(f *fetcher, path, out string) error {
+	b, err := renderTemplate(f, path)
+	if err != nil {
+		return err
+	}
+	if out == "" {
+		_, err = os.Stdout.Write(b)
+		return err
+	}
+	return writeFileAtomic(out, b, 0o600)
+}
+
+// writeFileAtomic writes via a temp file in the same directory and renames it
+// into place, so readers never observe a half-written file.
+func writeFileAtomic(path string, b []byte, mode os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), mode); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// Manifest lists templates to render in one invocation, like consul-template.
+type Manifest struct {
+	Templates []ManifestEntry `json:"templates"`
+	// Command runs once after all templates if any destination changed.
+	Command string `json:"command"`
+	// Staging switches to blue/green rendering; see renderStaged.
+	Staging *Staging `json:"staging"`
 }
 
-func fileExists(p string) bool {
-	_, err := os.Stat(p)
-	return err == nil
+// Staging configures blue/green rendering. Destinations are then paths
+// relative to a release directory.
+type Staging struct {
+	// Dir holds one release-* directory per rendered release.
+	Dir string `json:"dir"`
+	// Link is the symlink services read through; it is swapped atomically
+	// to the new release once Validate passes.
+	Link string `json:"link"`
+	// Validate is a shell command run with the staged release directory in
+	// CENTRAL_MCP_STAGED; a failure leaves Link untouched.
+	Validate string `json:"validate"`
+	// Keep is how many previous releases to retain (default 2).
+	Keep int `json:"keep"`
 }
 
-func loadConfig() (*Config, error) {
-	cfg := &Config{}
-	// First, read environment overrides (they take precedence)
-	if v := os.Getenv("CENTRAL_MCP_SERVER_URL"); v != "" {
-		cfg.CentralMcpServerUrl = v
+type ManifestEntry struct {
+	Template    string `json:"template"`
+	Destination string `json:"destination"`
+	// Mode is an octal file mode such as "0640"; default 0600.
+	Mode string `json:"mode"`
+	// Owner is "user" or "user:group"; not supported on Windows.
+	Owner string `json:"owner"`
+	// Command runs after this destination changed.
+	Command string `json:"command"`
+}
+
+func loadManifest(path string) (*Manifest, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
 	}
-	if v := os.Getenv("CENTRAL_MCP_SERVER_TOKEN"); v != "" {
-		cfg.CentralMcpServerToken = v
+	var m Manifest
+	if err := decodeJSON(b, &m); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", path, err)
 	}
-	if v := os.Getenv("CENTRAL_MCP_JWT_SECRET"); v != "" {
-		cfg.CentralMcpJwtSecret = v
+	for i, e := range m.Templates {
+		if e.Template == "" || e.Destination == "" {
+			return nil, fmt.Errorf("%s: templates[%d] needs template and destination", path, i)
+		}
+		if m.Staging != nil && !filepath.IsLocal(e.Destination) {
+			return nil, fmt.Errorf("%s: templates[%d] destination must be relative to the release directory when staging", path, i)
+		}
 	}
-
-	// Candidate file locations (prefer C:\ if present to match server behavior)
-	candidates := []string{
-		`C:\central-mcp-config.json`,
-		"central-mcp-config.json",
+	if m.Staging != nil && (m.Staging.Dir == "" || m.Staging.Link == "") {
+		return nil, fmt.Errorf("%s: staging needs dir and link", path)
 	}
+	return &m, nil
+}
 
-	for _, p := range candidates {
-		if fileExists(p) {
-			b, err := os.ReadFile(p)
-			if err != nil {
-				return nil, fmt.Errorf("failed to read %s: %w", p, err)
-			}
-			var fcfg Config
-			if err := json.Unmarshal(b, &fcfg); err != nil {
-				return nil, fmt.Errorf("failed to parse %s: %w", p, err)
+// renderManifest renders every entry, writes only destinations whose content
+// changed, and runs the per-entry and global commands for changes. Template
+// paths are relative to the manifest file.
+func renderManifest(f *fetcher, path string) error {
+	m, err := loadManifest(path)
+	if err != nil {
+		return err
+	}
+	base := filepath.Dir(path)
+	if m.Staging != nil {
+		return renderStaged(f, m, base)
+	}
+	changed := false
+	for _, e := range m.Templates {
+		b, mode, err := renderEntry(f, base, e)
+		if err != nil {
+			return err
+		}
+		if old, err := os.ReadFile(e.Destination); err == nil && bytes.Equal(old, b) {
+			continue
+		}
+		if err := writeFileAtomic(e.Destination, b, mode); err != nil {
+			return err
+		}
+		if e.Owner != "" {
+			if err := chownSpec(e.Destination, e.Owner); err != nil {
+				return fmt.Errorf("%s: %w", e.Destination, err)
 			}
-			// Merge: environment values already set take precedence
-			if cfg.CentralMcpServerUrl == "" {
-				cfg.CentralMcpServerUrl = fcfg.CentralMcpServerUrl
+		}
+		fmt.Fprintln(stderr, "rendered", e.Destination)
+		changed = true
+		if e.Command != "" {
+			if err := runShell(e.Command); err != nil {
+				return fmt.Errorf("command for %s: %w", e.Destination, err)
 			}
-			if cfg.CentralMcpServerToken == "" {
-				cfg.CentralMcpServerToken = fcfg.CentralMcpServerToken
+		}
+	}
+	if changed && m.Command != "" {
+		if err := runShell(m.Command); err != nil {
+			return fmt.Errorf("command: %w", err)
+		}
+	}
+	return nil
+}
+
+var composePlaceholder = regexp.MustCompile(`\$\{CENTRAL_MCP:([^}]+)\}`)
+
+// renderCompose resolves ${CENTRAL_MCP:name} placeholders in a compose file.
+// Without envFile the values are inlined as YAML (see composeInline), with
+// "$" doubled so compose does not interpolate them. With envFile each placeholder becomes a
+// ${CENTRAL_MCP_<NAME>} reference and the values go to that .env file
+// (mode 0600) instead, keeping them out of the compose file.
+func renderCompose(f *fetcher, path, envFile string) ([]byte, error) {
+	src, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	values := map[string]string{}
+	vars := map[string]string{}
+	for _, m := range composePlaceholder.FindAllSubmatch(src, -1) {
+		name := string(m[1])
+		if _, ok := values[name]; ok {
+			continue
+		}
+		v, err := f.get(name)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		values[name] = v
+		key := composeVar(name)
+		if other, ok := vars[key]; ok {
+			return nil, &exitError{2, fmt.Errorf("secrets %q and %q both map to %s", other, name, key)}
+		}
+		vars[key] = name
+	}
+	var out []byte
+	last := 0
+	for _, m := range composePlaceholder.FindAllSubmatchIndex(src, -1) {
+		name := string(src[m[2]:m[3]])
+		out = append(out, src[last:m[0]]...)
+		last = m[1]
+		if envFile != "" {
+			out = append(out, "${"+composeVar(name)+"}"...)
+			continue
+		}
+		lineStart := bytes.LastIndexByte(src[:m[0]], '\n') + 1
+		lineEnd := len(src)
+		if i := bytes.IndexByte(src[m[1]:], '\n'); i >= 0 {
+			lineEnd = m[1] + i
+		}
+		v, err := composeInline(values[name], string(src[lineStart:m[0]]), string(src[m[1]:lineEnd]))
+		if err != nil {
+			return nil, &exitError{2, fmt.Errorf("%s: %w; use -compose-env to keep it out of the compose file", name, err)}
+		}
+		out = append(out, v...)
+	}
+	out = append(out, src[last:]...)
+	if envFile != "" {
+		var env bytes.Buffer
+		for _, key := range slices.Sorted(maps.Keys(vars)) {
+			fmt.Fprintf(&env, "%s=%s\n", key, dotenvQuote(values[vars[key]]))
+		}
+		if err := writeFileAtomic(envFile, env.Bytes(), 0o600); err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
+
+// composeInline renders a secret value for the spot its placeholder occupies,
+// given the text before and after it on the same line. A placeholder that is
+// a whole plain scalar becomes a YAML double-quoted scalar and one inside a
+// double-quoted string is escaped for it. Anywhere else (part of a plain or
+// single-quoted scalar, a comment) only values that cannot change the
+// document structure are spliced in as-is.
+func composeInline(v, before, after string) (string, error) {
+	if !utf8.ValidString(v) {
+		return "", errors.New("value is not valid UTF-8")
+	}
+	v = strings.ReplaceAll(v, "$", "$$")
+	rest := strings.TrimSpace(after)
+	whole := rest == "" || strings.HasPrefix(rest, "#")
+	switch lead := strings.TrimRight(before, " \t"); {
+	case whole && (strings.HasSuffix(lead, ":") || strings.TrimLeft(lead, " \t") == "-"):
+		return `"` + yamlEscape(v) + `"`, nil
+	case yamlInDoubleQuotes(before):
+		return yamlEscape(v), nil
+	}
+	for _, r := range v {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("-_.+/=~@%^$", r)) {
+			return "", fmt.Errorf("value has %q and the placeholder is not a whole YAML value", r)
+		}
+	}
+	return v, nil
+}
+
+// yamlEscape escapes s for the inside of a YAML double-quoted scalar.
+func yamlEscape(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch {
+		case r == '\\' || r == '"':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case r == '\n':
+			b.WriteString(`\n`)
+		case r == '\t':
+			b.WriteString(`\t`)
+		case r == '\r':
+			b.WriteString(`\r`)
+		case r < 0x20 || r == 0x7f:
+			fmt.Fprintf(&b, `\x%02X`, r)
+		case r == 0x85 || r == 0x2028 || r == 0x2029 || r == 0xfeff:
+			fmt.Fprintf(&b, `\u%04X`, r)
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// yamlInDoubleQuotes reports whether a line prefix leaves an open YAML
+// double-quoted scalar. Quotes only open a scalar at its start; one in the
+// middle of a plain scalar is an ordinary character.
+func yamlInDoubleQuotes(line string) bool {
+	var quote byte
+	prev := byte(' ') // previous non-blank character outside quotes
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case quote == '"' && c == '\\':
+			i++
+		case quote != 0:
+			if c == quote {
+				quote, prev = 0, c
 			}
-			if cfg.CentralMcpJwtSecret == "" {
-				cfg.CentralMcpJwtSecret = fcfg.CentralMcpJwtSecret
+		case c == ' ' || c == '\t':
+			if i+1 < len(line) && line[i+1] == '#' {
+				return false
 			}
-			if cfg.Secrets == nil {
-				cfg.Secrets = fcfg.Secrets
+			if prev == ':' || prev == '-' || prev == ',' {
+				prev = ' '
 			}
-			return cfg, nil
+		case (c == '"' || c == '\'') && strings.IndexByte(" [{", prev) >= 0:
+			quote = c
+		case c == '#' && i == 0:
+			return false
+		default:
+			prev = c
 		}
 	}
+	return quote == '"'
+}
 
-	// No file found, return whatever we have from env (may be empty)
-	return cfg, nil
+// composeVar turns a secret name into a CENTRAL_MCP_<NAME> variable name.
+func composeVar(name string) string {
+	return "CENTRAL_MCP_" + strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		}
+		return '_'
+	}, name)
 }
 
-func requestJWT(serverURL, serverToken string) (string, error) {
-	if serverURL == "" {
-		return "", errors.New("server URL is empty")
+// dotenvQuote quotes a value for a compose .env file: single quotes (no
+// interpolation) when possible, otherwise double quotes with escapes.
+func dotenvQuote(v string) string {
+	if !strings.ContainsAny(v, "'\n\r") {
+		return "'" + v + "'"
 	}
-	if serverToken == "" {
-		return "", errors.New("server token is empty")
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "$", `\$`, "\n", `\n`, "\r", `\r`)
+	return `"` + r.Replace(v) + `"`
+}
+
+func renderEntry(f *fetcher, base string, e ManifestEntry) ([]byte, os.FileMode, error) {
+	tpath := e.Template
+	if !filepath.IsAbs(tpath) {
+		tpath = filepath.Join(base, tpath)
 	}
-	client := &http.Client{Timeout: 5 * time.Second}
-	req, err := http.NewRequest("POST", strings.TrimRight(serverURL, "/")+"/token", nil)
+	b, err := renderTemplate(f, tpath)
 	if err != nil {
-		return "", err
+		return nil, 0, fmt.Errorf("%s: %w", e.Template, err)
 	}
-	req.Header.Set("Authorization", "Bearer "+serverToken)
-	resp, err := client.Do(req)
+	mode := os.FileMode(0o600)
+	if e.Mode != "" {
+		n, err := strconv.ParseUint(e.Mode, 8, 32)
+		if err != nil {
+			return nil, 0, fmt.Errorf("%s: invalid mode %q", e.Destination, e.Mode)
+		}
+		mode = os.FileMode(n)
+	}
+	return b, mode, nil
+}
+
+// renderStaged renders every template into a new release directory, runs the
+// validation command against it, and only then atomically repoints the
+// staging link, so a bad secret never reaches a service mid-reload. Nothing
+// is written when no file changed.
+func renderStaged(f *fetcher, m *Manifest, base string) error {
+	st := m.Staging
+	type rendered struct {
+		e    ManifestEntry
+		b    []byte
+		mode os.FileMode
+	}
+	var files []rendered
+	changed := false
+	for _, e := range m.Templates {
+		b, mode, err := renderEntry(f, base, e)
+		if err != nil {
+			return err
+		}
+		if old, err := os.ReadFile(filepath.Join(st.Link, e.Destination)); err != nil || !bytes.Equal(old, b) {
+			changed = true
+		}
+		files = append(files, rendered{e, b, mode})
+	}
+	if !changed {
+		return nil
+	}
+
+	if err := os.MkdirAll(st.Dir, 0o755); err != nil {
+		return err
+	}
+	release, err := os.MkdirTemp(st.Dir, "release-"+time.Now().UTC().Format("20060102T150405")+"-")
 	if err != nil {
-		return "", err
+		return err
 	}
-	defer resp.Body.Close()
-	if resp.StatusCode != 200 {
-		b, _ := io.ReadAll(resp.Body)
-		return "", fmt.Errorf("token request failed %d: %s", resp.StatusCode, string(b))
+	fail := func(err error) error {
+		os.RemoveAll(release)
+		return err
 	}
-	var body struct {
-		AccessToken string `json:"access_token"`
+	// a symlink target resolves relative to the link's directory, not the
+	// cwd, so the link must point at an absolute path
+	if release, err = filepath.Abs(release); err != nil {
+		return fail(err)
 	}
-	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
-		return "", err
+	if err := os.Chmod(release, 0o755); err != nil {
+		return fail(err)
 	}
-	if body.AccessToken == "" {
-		return "", errors.New("no access_token in response")
+	for _, r := range files {
+		dst := filepath.Join(release, r.e.Destination)
+		if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+			return fail(err)
+		}
+		if err := writeFileAtomic(dst, r.b, r.mode); err != nil {
+			return fail(err)
+		}
+		if r.e.Owner != "" {
+			if err := chownSpec(dst, r.e.Owner); err != nil {
+				return fail(fmt.Errorf("%s: %w", r.e.Destination, err))
+			}
+		}
+	}
+	if st.Validate != "" {
+		if err := runShell(st.Validate, "CENTRAL_MCP_STAGED="+release); err != nil {
+			return fail(fmt.Errorf("validation failed, %s still points at the previous release: %w", st.Link, err))
+		}
+	}
+
+	// rename over the old link is atomic; the link itself never dangles
+	tmp := st.Link + ".tmp"
+	os.Remove(tmp)
+	if err := os.Symlink(release, tmp); err != nil {
+		return fail(err)
+	}
+	if fi, err := os.Stat(tmp); err != nil || !fi.IsDir() {
+		os.Remove(tmp)
+		return fail(fmt.Errorf("new link %s does not resolve to %s", tmp, release))
+	}
+	if err := os.Rename(tmp, st.Link); err != nil {
+		os.Remove(tmp)
+		return fail(err)
+	}
+	if _, err := os.Stat(filepath.Join(st.Link, files[0].e.Destination)); err != nil {
+		return fmt.Errorf("%s was switched but does not resolve: %w", st.Link, err)
+	}
+	fmt.Fprintln(stderr, "switched", st.Link, "to", release)
+
+	for _, r := range files {
+		if r.e.Command != "" {
+			if err := runShell(r.e.Command); err != nil {
+				return fmt.Errorf("command for %s: %w", r.e.Destination, err)
+			}
+		}
+	}
+	if m.Command != "" {
+		if err := runShell(m.Command); err != nil {
+			return fmt.Errorf("command: %w", err)
+		}
 	}
-	return body.AccessToken, nil
+	return pruneReleases(st, release)
 }
 
-func getSecret(serverURL, jwt, name string) (string, error) {
-	if serverURL == "" {
-		return "", errors.New("server URL is empty")
+// pruneReleases removes all but the newest Keep releases besides current.
+func pruneReleases(st *Staging, current string) error {
+	keep := st.Keep
+	if keep <= 0 {
+		keep = 2
 	}
-	client := &http.Client{Timeout: 5 * time.Second}
-	req, err := http.NewRequest("GET", strings.TrimRight(serverURL, "/")+"/secrets/"+urlEscape(name), nil)
+	entries, err := os.ReadDir(st.Dir)
 	if err != nil {
-		return "", err
+		return err
 	}
-	req.Header.Set("Authorization", "Bearer "+jwt)
-	resp, err := client.Do(req)
+	var old []string
+	for _, e := range entries {
+		if e.IsDir() && strings.HasPrefix(e.Name(), "release-") && e.Name() != filepath.Base(current) {
+			old = append(old, filepath.Join(st.Dir, e.Name()))
+		}
+	}
+	// names start with a UTC timestamp, so they sort oldest first
+	sort.Strings(old)
+	for len(old) > keep {
+		if err := os.RemoveAll(old[0]); err != nil {
+			return err
+		}
+		old = old[1:]
+	}
+	return nil
+}
+
+// chownSpec changes ownership to "user" or "user:group" (names or ids).
+func chownSpec(path, spec string) error {
+	name, group, _ := strings.Cut(spec, ":")
+	u, err := user.Lookup(name)
 	if err != nil {
-		return "", err
+		if u, err = user.LookupId(name); err != nil {
+			return err
+		}
 	}
-	defer resp.Body.Close()
-	b, _ := io.ReadAll(resp.Body)
-	if resp.StatusCode != 200 {
-		return "", fmt.Errorf("secret request failed %d: %s", resp.StatusCode, string(b))
+	uid, err := strconv.Atoi(u.Uid)
+	if err != nil {
+		return fmt.Errorf("owner %q has no numeric uid", name)
 	}
-	var out struct {
-		Name  string `json:"name"`
-		Value string `json:"value"`
+	gid := -1
+	if group != "" {
+		g, err := user.LookupGroup(group)
+		if err != nil {
+			if g, err = user.LookupGroupId(group); err != nil {
+				return err
+			}
+		}
+		if gid, err = strconv.Atoi(g.Gid); err != nil {
+			return fmt.Errorf("group %q has no numeric gid", group)
+		}
 	}
-	if err := json.Unmarshal(b, &out); err != nil {
-		return "", err
+	return os.Chown(path, uid, gid)
+}
+
+// runShell runs a command line through the platform shell with stdout and
+// stderr passed through and any extra environment variables appended.
+func runShell(command string, env ...string) error {
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.Command("cmd", "/C", command)
+	} else {
+		cmd = exec.Command("sh", "-c", command)
 	}
-	return out.Value, nil
+	if len(env) > 0 {
+		cmd.Env = append(os.Environ(), env...)
+	}
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
 }
 
 func urlEscape(s string) string {
-	// simple escape for path segment
-	return strings.ReplaceAll(s, " ", "%20")
+	// escape as a single path segment so "/" in names survives routing
+	return url.PathEscape(s)
 }
 
 func mask(s string) string {
@@ -156,19 +4335,367 @@ func mask(s string) string {
 func main() {
 	secretFlag := flag.String("secret", "", "Secret name to fetch from central server")
 	showCfg := flag.Bool("show", false, "Print resolved configuration (masked)")
+	explain := flag.String("explain", "", "Report which source (env, file or default) supplies a setting, e.g. centralMcpServerUrl, and exit")
+	flag.Bool("sign", false, "Sign requests with the JWT secret (HMAC) instead of sending a bearer token")
+	inspectTokenFlag := flag.Bool("inspect-token", false, "Obtain a JWT and print its claims, expiry and revocation status, then exit")
+	flag.String("scope", "", "Request a JWT limited to this scope, e.g. read, for agents that only read secrets")
+	allowInsecure := flag.Bool("allow-insecure-config", false, "Use a config file with credentials even if it is readable by other users")
+	harden := flag.Bool("harden-config", false, "Restrict config file permissions to 0600 (on Windows, only move it out of C:\\) then exit")
+	migrate := flag.Bool("migrate-config", false, "Rewrite the config file in the current schemaVersion layout then exit")
+	flag.Duration("cache-ttl", 0, "Cache fetched secrets on disk (encrypted) for this long; 0 disables the cache")
+	cachePurge := flag.Bool("cache-purge", false, "Remove the on-disk secret cache and exit")
+	pingFlag := flag.Bool("ping", false, "Check connectivity to the server's /health endpoint and exit")
+	ipv4 := flag.Bool("4", false, "Connect over IPv4 only")
+	ipv6 := flag.Bool("6", false, "Connect over IPv6 only")
+	flag.Bool("fips", false, "Restrict crypto to FIPS-approved algorithms; requires the Go FIPS 140 module")
+	doctor := flag.Bool("doctor", false, "Print a diagnostic report about config, connectivity, clock and TLS, then exit")
+	flag.String("reason", "", "Justification for reading the secret, recorded in the server audit log")
+	templateFlag := flag.String("template", "", "Render a Go text/template file (\"-\" for stdin) with secret lookups")
+	outFlag := flag.String("out", "", "Write -secret, -template or -kubeconfig output to this file (mode 0600) instead of stdout")
+	manifestFlag := flag.String("manifest", "", "Render all templates listed in a JSON manifest file")
+	execFlag := flag.Bool("exec", false, "Run the command given after the flags with secrets injected as env vars (see -env and envMapping)")
+	envMap := envFlag{}
+	flag.Var(envMap, "env", "Map an env var to a secret for -exec, as NAME=secret, or PREFIX*=secret to expand every field of a map secret (repeatable)")
+	flag.String("client-name", "", "Name this client in the User-Agent sent to the server, e.g. checkout")
+	flag.String("client-tags", "", "Tags sent with every request for audit attribution, e.g. service=checkout,pipeline=deploy-42")
+	flag.String("overlay", "", "Apply the named config overlay (e.g. prod, staging) on top of the base envMapping")
+	fieldFlag := flag.String("field", "", "Print one field (dot path) of a map -secret instead of the whole value")
+	watch := flag.Duration("watch", 0, "With -exec, re-fetch secrets on this interval and react to changes")
+	scrub := flag.Bool("scrub-env", false, "With -exec, remove CENTRAL_MCP_* and the scrubEnv patterns from the command's environment")
+	onChange := flag.String("on-change", "restart", "With -exec -watch, restart the command or send it a signal (HUP, INT, QUIT, TERM) when secrets change")
+	applyFlag := flag.String("apply", "", "Make the server's MCP registry match a declarative JSON or YAML file")
+	prune := flag.Bool("prune", false, "With -apply, unregister servers that are not in the file")
+	planFlag := flag.String("plan", "", "Report drift between a declarative JSON or YAML registry file and the server without applying (exit 5 on drift)")
+	totpFlag := flag.String("totp", "", "Fetch a stored TOTP seed (base32 or otpauth:// URI) and print the current code")
+	formatFlag := flag.String("format", "", "Render the -secret value as: raw (default), dsn, npmrc, pip or maven; with -show: text (default), json or yaml")
+	driverFlag := flag.String("driver", "", "Database driver for -format dsn: postgres, mysql, sqlserver or mongodb")
+	cloudFlag := flag.String("cloud-credentials", "", "Install the -secret value as aws, gcp or azure credentials in the provider's standard location")
+	profile := flag.String("profile", "default", "AWS profile section for -cloud-credentials aws")
+	kubeconfig := flag.String("kubeconfig", "", "Print a kubeconfig for a cluster stored under kubernetes/<cluster>/ (server, ca, token)")
+	kubeExec := flag.Bool("kube-exec", false, "With -kubeconfig, fetch the token at use time through an exec credential plugin instead of embedding it")
+	k8sExecCred := flag.String("k8s-exec-credential", "", "Act as a kubectl exec credential plugin for a stored cluster (caches the token for 5m unless -cache-ttl is set)")
+	credMap := envFlag{}
+	flag.Var(credMap, "cred", "Map a systemd credential ID to a secret, as ID=secret (repeatable)")
+	credDir := flag.String("credentials-dir", "", "Write every -cred secret to DIR/ID (mode 0400) for systemd LoadCredential=, then exit")
+	credSocket := flag.String("credentials-socket", "", "Serve systemd LoadCredential= requests on this unix socket path")
+	composeFlag := flag.String("compose", "", "Resolve ${CENTRAL_MCP:name} placeholders in a compose file and print it (or write it to -out)")
+	composeEnv := flag.String("compose-env", "", "With -compose, write the values to this .env file and leave ${CENTRAL_MCP_<NAME>} references in the compose file")
+	dockerPlugin := flag.String("docker-secret-plugin", "", "Serve the Docker secret driver plugin API on this unix socket, e.g. /run/docker/plugins/central-mcp.sock")
+	waitReadyFlag := flag.Bool("wait-ready", false, "Block until the server is reachable and all -secrets are fetchable, then exit")
+	secretsList := flag.String("secrets", "", "Comma-separated secret names for -wait-ready")
+	timeout := flag.Duration("timeout", 2*time.Minute, "How long -wait-ready waits before failing")
+	checkNames := flag.Bool("check-names", false, "Report local secret names that do not follow the naming rules and exit")
 	flag.Parse()
 
-	cfg, err := loadConfig()
+	if *cachePurge {
+		dir, err := cacheDir()
+		if err == nil {
+			err = os.RemoveAll(dir)
+		}
+		if err != nil {
+			fmt.Fprintln(stderr, "failed to purge cache:", err)
+			os.Exit(1)
+		}
+		fmt.Println("cache purged:", dir)
+		os.Exit(0)
+	}
+
+	if *ipv4 && *ipv6 {
+		fmt.Fprintln(stderr, "-4 and -6 are mutually exclusive")
+		os.Exit(2)
+	}
+	flagValues := map[string]string{}
+	if *ipv4 {
+		flagValues["ipFamily"] = "4"
+	}
+	if *ipv6 {
+		flagValues["ipFamily"] = "6"
+	}
+	// only flags given on the command line override env and file, so an
+	// explicit -fips=false still beats "fips": true in the file
+	flag.Visit(func(fl *flag.Flag) {
+		for _, o := range configOptions {
+			if o.flag == "-"+fl.Name {
+				flagValues[o.key] = fl.Value.String()
+			}
+		}
+	})
+	cfg, err := loadConfig(flagValues)
 	if err != nil {
-		fmt.Fprintln(os.Stderr, "failed to load config:", err)
+		fmt.Fprintln(stderr, "failed to load config:", err)
 		os.Exit(1)
 	}
+	if !cfg.CoreDumps {
+		disableCoreDumps()
+	}
+
+	if *harden {
+		p, err := hardenConfig(cfg)
+		if err != nil {
+			fmt.Fprintln(stderr, "failed to harden config:", err)
+			os.Exit(1)
+		}
+		fmt.Println("config hardened:", p)
+		os.Exit(0)
+	}
+	if *migrate {
+		from, err := migrateConfigFile(cfg)
+		if err != nil {
+			fmt.Fprintln(stderr, "failed to migrate config:", err)
+			os.Exit(1)
+		}
+		if from == currentSchemaVersion {
+			fmt.Printf("config already at schemaVersion %d: %s\n", from, cfg.path)
+		} else {
+			fmt.Printf("config migrated from schemaVersion %d to %d: %s\n", from, currentSchemaVersion, cfg.path)
+		}
+		os.Exit(0)
+	}
+	// doctor reports insecure configs itself rather than refusing them
+	if !*allowInsecure && !*doctor {
+		if err := checkConfigPermissions(cfg); err != nil {
+			fmt.Fprintln(stderr, "refusing insecure config:", err)
+			os.Exit(1)
+		}
+	}
+
+	if *checkNames {
+		bad := nonConformingNames(cfg.Secrets, cfg.NameCase)
+		for _, b := range bad {
+			fmt.Println(b)
+		}
+		if len(bad) > 0 {
+			os.Exit(1)
+		}
+		fmt.Println("all secret names conform")
+		os.Exit(0)
+	}
+
+	if *explain != "" {
+		if err := explainOption(os.Stdout, cfg, *explain); err != nil {
+			fmt.Fprintln(stderr, err)
+			os.Exit(2)
+		}
+		os.Exit(0)
+	}
 
 	if *showCfg {
-		fmt.Println("resolved config:")
-		fmt.Println("  serverUrl:", cfg.CentralMcpServerUrl)
-		fmt.Println("  serverToken:", mask(cfg.CentralMcpServerToken))
-		fmt.Println("  jwtSecret:", mask(cfg.CentralMcpJwtSecret))
+		if err := showConfig(os.Stdout, cfg, *formatFlag); err != nil {
+			fmt.Fprintln(stderr, err)
+			os.Exit(2)
+		}
+		os.Exit(0)
+	}
+
+	if cfg.Scope != "" && cfg.Sign {
+		fmt.Fprintln(stderr, "-scope needs a server-issued JWT and cannot be combined with -sign")
+		os.Exit(2)
+	}
+	if cfg.Scope == "read" && *applyFlag != "" {
+		fmt.Fprintln(stderr, "-apply changes the registry and cannot run with -scope read")
+		os.Exit(2)
+	}
+	var f *fetcher
+	client, err := newHTTPClient(cfg)
+	if err == nil {
+		f, err = newFetcher(cfg, client)
+	}
+	if err != nil {
+		fmt.Fprintln(stderr, "failed to load config:", err)
+		os.Exit(1)
+	}
+
+	if *doctor {
+		if !runDoctor(cfg, client) {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	if *pingFlag {
+		if cfg.CentralMcpServerUrl == "" {
+			fmt.Fprintln(stderr, "no server URL configured (env CENTRAL_MCP_SERVER_URL or central-mcp-config.json)")
+			os.Exit(2)
+		}
+		out, err := ping(client, cfg.CentralMcpServerUrl)
+		if err != nil {
+			fmt.Fprintln(stderr, "ping failed:", err)
+			os.Exit(3)
+		}
+		fmt.Println(out)
+		os.Exit(0)
+	}
+
+	if *inspectTokenFlag {
+		if err := inspectToken(os.Stdout, f); err != nil {
+			fmt.Fprintln(stderr, err)
+			os.Exit(exitCode(err))
+		}
+		os.Exit(0)
+	}
+
+	if *dockerPlugin != "" {
+		if err := serveDockerSecrets(f, *dockerPlugin); err != nil {
+			fmt.Fprintln(stderr, "docker secret plugin failed:", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	if *credDir != "" || *credSocket != "" {
+		if *credDir != "" {
+			err = writeCredentials(f, *credDir, credMap)
+		} else {
+			err = serveCredentials(f, *credSocket, credMap)
+		}
+		if err != nil {
+			fmt.Fprintln(stderr, "failed to provide credentials:", err)
+			os.Exit(exitCode(err))
+		}
+		os.Exit(0)
+	}
+
+	if *waitReadyFlag {
+		var names []string
+		for _, n := range strings.Split(*secretsList, ",") {
+			if n = strings.TrimSpace(n); n != "" {
+				names = append(names, n)
+			}
+		}
+		if err := waitReady(f, names, *timeout); err != nil {
+			fmt.Fprintln(stderr, err)
+			if transient(err) {
+				os.Exit(1)
+			}
+			os.Exit(exitCode(err))
+		}
+		fmt.Println("ready")
+		os.Exit(0)
+	}
+
+	if *execFlag {
+		if flag.NArg() == 0 {
+			fmt.Fprintln(stderr, "-exec needs a command, e.g. -exec -- ./server --port 8080")
+			os.Exit(2)
+		}
+		mapping := map[string]string{}
+		for k, v := range cfg.EnvMapping {
+			mapping[k] = v
+		}
+		for k, v := range envMap {
+			mapping[k] = v
+		}
+		base := os.Environ()
+		if *scrub {
+			base = scrubEnv(base, append([]string{"CENTRAL_MCP_*"}, cfg.ScrubEnv...))
+		}
+		code, err := runExec(f, mapping, base, flag.Args(), *watch, *onChange)
+		if err != nil {
+			fmt.Fprintln(stderr, "exec failed:", err)
+		}
+		os.Exit(code)
+	}
+
+	if *planFlag != "" {
+		if cfg.CentralMcpServerUrl == "" {
+			fmt.Fprintln(stderr, "no server URL configured (env CENTRAL_MCP_SERVER_URL or central-mcp-config.json)")
+			os.Exit(2)
+		}
+		drift, err := planRegistryFile(client, cfg.CentralMcpServerUrl, *planFlag)
+		if err != nil {
+			fmt.Fprintln(stderr, "failed to plan registry:", err)
+			os.Exit(1)
+		}
+		if drift {
+			os.Exit(5)
+		}
+		os.Exit(0)
+	}
+
+	if *applyFlag != "" {
+		if cfg.CentralMcpServerUrl == "" {
+			fmt.Fprintln(stderr, "no server URL configured (env CENTRAL_MCP_SERVER_URL or central-mcp-config.json)")
+			os.Exit(2)
+		}
+		if err := applyRegistry(f, *applyFlag, *prune); err != nil {
+			fmt.Fprintln(stderr, "failed to apply registry:", err)
+			os.Exit(exitCode(err))
+		}
+		os.Exit(0)
+	}
+
+	if *manifestFlag != "" {
+		if err := renderManifest(f, *manifestFlag); err != nil {
+			fmt.Fprintln(stderr, "failed to render manifest:", err)
+			os.Exit(exitCode(err))
+		}
+		os.Exit(0)
+	}
+
+	if *composeFlag != "" {
+		b, err := renderCompose(f, *composeFlag, *composeEnv)
+		if err == nil {
+			if *outFlag != "" {
+				err = writeFileAtomic(*outFlag, b, 0o600)
+			} else {
+				_, err = os.Stdout.Write(b)
+			}
+		}
+		if err != nil {
+			fmt.Fprintln(stderr, "failed to render compose file:", err)
+			os.Exit(exitCode(err))
+		}
+		os.Exit(0)
+	}
+
+	if *templateFlag != "" {
+		if err := renderTemplateFile(f, *templateFlag, *outFlag); err != nil {
+			fmt.Fprintln(stderr, "failed to render template:", err)
+			os.Exit(exitCode(err))
+		}
+		os.Exit(0)
+	}
+
+	if *kubeconfig != "" || *k8sExecCred != "" {
+		// kubectl runs the plugin for every command; cache by default when
+		// the cache can be encrypted
+		if *k8sExecCred != "" && f.ttl == 0 && cfg.CentralMcpJwtSecret != "" {
+			f.ttl = 5 * time.Minute
+		}
+		var b []byte
+		if *kubeconfig != "" {
+			b, err = buildKubeconfig(f, *kubeconfig, *kubeExec)
+		} else {
+			b, err = execCredential(f, *k8sExecCred)
+		}
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			os.Exit(exitCode(err))
+		}
+		if *outFlag != "" {
+			err = writeFileAtomic(*outFlag, append(b, '\n'), 0o600)
+		} else {
+			_, err = fmt.Printf("%s\n", b)
+		}
+		if err != nil {
+			fmt.Fprintln(stderr, "failed to write output:", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	if *totpFlag != "" {
+		seed, err := f.get(*totpFlag)
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			os.Exit(exitCode(err))
+		}
+		code, err := totpCode(seed, time.Now())
+		if err != nil {
+			fmt.Fprintln(stderr, "failed to generate TOTP code:", err)
+			os.Exit(4)
+		}
+		fmt.Println(code)
 		os.Exit(0)
 	}
 
@@ -185,26 +4712,37 @@ func main() {
 		os.Exit(0)
 	}
 
-	// Need server URL and server token (either from env/file)
-	if cfg.CentralMcpServerUrl == "" {
-		fmt.Fprintln(os.Stderr, "no server URL configured (env CENTRAL_MCP_SERVER_URL or central-mcp-config.json)")
-		os.Exit(2)
+	val, err := f.get(*secretFlag)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		os.Exit(exitCode(err))
 	}
-	if cfg.CentralMcpServerToken == "" {
-		fmt.Fprintln(os.Stderr, "no server token configured (env CENTRAL_MCP_SERVER_TOKEN or central-mcp-config.json)")
-		os.Exit(2)
+	if *cloudFlag != "" {
+		dst, err := writeCloudCredentials(*cloudFlag, *profile, val)
+		if err != nil {
+			fmt.Fprintln(stderr, "failed to write cloud credentials:", err)
+			os.Exit(1)
+		}
+		fmt.Println("credentials written:", dst)
+		os.Exit(0)
 	}
-
-	jwt, err := requestJWT(cfg.CentralMcpServerUrl, cfg.CentralMcpServerToken)
-	if err != nil {
-		fmt.Fprintln(os.Stderr, "failed to obtain JWT:", err)
-		os.Exit(3)
+	if *fieldFlag != "" {
+		if val, err = jsonField(*fieldFlag, val); err != nil {
+			fmt.Fprintln(stderr, "failed to extract field:", err)
+			os.Exit(4)
+		}
 	}
-
-	val, err := getSecret(cfg.CentralMcpServerUrl, jwt, *secretFlag)
+	out, err := formatSecret(*formatFlag, *driverFlag, val)
 	if err != nil {
-		fmt.Fprintln(os.Stderr, "failed to fetch secret:", err)
-		os.Exit(4)
+		fmt.Fprintln(stderr, "failed to format secret:", err)
+		os.Exit(2)
+	}
+	if *outFlag != "" {
+		if err := writeFileAtomic(*outFlag, []byte(out), 0o600); err != nil {
+			fmt.Fprintln(stderr, "failed to write output:", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
 	}
-	fmt.Printf("%s\n", val)
+	fmt.Printf("%s\n", out)
 }
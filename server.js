@@ -19,13 +19,27 @@ const {
   createSecurityHeadersMiddleware,
   createHealthCheckMiddleware
 } = require('./middleware/monitoring');
+const {
+  parseRequestedScope,
+  scopeAllows,
+  createSignatureVerifier
+} = require('./middleware/auth');
+const { parseTrustedProxies, corsOptions } = require('./middleware/network');
 const app = express();
 const port = process.env.PORT || 5050;
 const logger = require("./logger");
 
+// Behind a load balancer, believe X-Forwarded-For only from the proxies in
+// CENTRAL_MCP_TRUSTED_PROXIES so req.ip (audit log, rate limiting) is the
+// real client address. Unset keeps the socket address.
+const TRUSTED_PROXIES = parseTrustedProxies(process.env.CENTRAL_MCP_TRUSTED_PROXIES);
+if (TRUSTED_PROXIES.length > 0) {
+  app.set('trust proxy', TRUSTED_PROXIES);
+}
+
 // Security and monitoring middleware
 app.use(helmet());
-app.use(cors());
+app.use(cors(corsOptions(process.env)));
 app.use(createSecurityHeadersMiddleware());
 app.use(createHealthCheckMiddleware(monitoringSystem, mcpRegistry, loadBalancer));
 app.use(createRequestLoggingMiddleware());
@@ -36,7 +50,11 @@ app.use(createRateLimitingMiddleware(monitoringSystem, {
 }));
 
 // Body parsing middleware
-app.use(express.json({ limit: '10mb' }));
+// keep the raw body so signed requests can be checked against its hash
+app.use(express.json({
+  limit: '10mb',
+  verify: (req, res, buf) => { req.rawBody = buf; }
+}));
 app.use(express.urlencoded({ extended: true, limit: '10mb' }));
 
 // Serve static files for dashboard
@@ -183,9 +201,24 @@ app.post("/unregister", (req, res) => {
   }
 });
 
+// HMAC-signed requests (read_config -sign); see createSignatureVerifier.
+const checkRequestSignature = createSignatureVerifier();
+
+function verifyRequestSignature(req) {
+  if (!JWT_SECRET || JWT_SECRET === "dev-jwt-secret")
+    return "Request signing not configured";
+  return checkRequestSignature(req, JWT_SECRET);
+}
+
 function requireAuth(req, res, next) {
   // Read token from env or file on every request to avoid stale in-memory state
   reloadJwtSecret();
+  if (req.get("X-Central-Mcp-Signature")) {
+    const problem = verifyRequestSignature(req);
+    if (problem) return res.status(401).json({ error: problem });
+    req.signed = true;
+    return next();
+  }
   let cfgToken = process.env.CENTRAL_MCP_SERVER_TOKEN || null;
   try {
     const workspaceCfg = path.join(__dirname, "central-mcp-config.json");
@@ -224,13 +257,17 @@ function requireAuth(req, res, next) {
   }
 
   // Finally, try to verify as a JWT
+  let payload;
   try {
-    const payload = jwt.verify(token, JWT_SECRET || "dev-jwt-secret");
-    req.jwt = payload;
-    return next();
+    payload = jwt.verify(token, JWT_SECRET || "dev-jwt-secret");
   } catch {
     return res.status(403).json({ error: "Forbidden" });
   }
+  // a token narrowed with /token?scope=read cannot change anything
+  if (!scopeAllows(payload, req))
+    return res.status(403).json({ error: "insufficient_scope" });
+  req.jwt = payload;
+  return next();
 }
 
 // Issue short-lived JWTs when client presents the server token
@@ -255,9 +292,17 @@ app.post("/token", (req, res) => {
     return res.status(503).json({ error: "Server token not configured" });
   if (token !== currentToken)
     return res.status(403).json({ error: "Forbidden" });
+  // optional OAuth-style scope parameter (form or JSON body) narrows the JWT
+  const requested = parseRequestedScope(req.body && req.body.scope);
+  if (requested.error)
+    return res
+      .status(400)
+      .json({ error: "invalid_scope", error_description: requested.error });
 
+  const claims = { iss: "central-mcp" };
+  if (requested.scope) claims.scope = requested.scope;
   const accessToken = jwt.sign(
-    { iss: "central-mcp" },
+    claims,
     JWT_SECRET || "dev-jwt-secret",
     {
       expiresIn: "15m",
@@ -270,6 +315,26 @@ app.post("/token", (req, res) => {
   });
 });
 
+// RFC 7662 style introspection: reports whether a JWT is still accepted,
+// e.g. after the JWT secret was rotated. Only active tokens get claims back.
+app.post("/token/introspect", requireAuth, (req, res) => {
+  const token = req.body && req.body.token;
+  if (typeof token !== "string" || !token)
+    return res.status(400).json({ error: "token is required" });
+  try {
+    const payload = jwt.verify(token, JWT_SECRET || "dev-jwt-secret");
+    res.json({
+      active: true,
+      iss: payload.iss,
+      scope: payload.scope,
+      iat: payload.iat,
+      exp: payload.exp,
+    });
+  } catch {
+    res.json({ active: false });
+  }
+});
+
 app.get("/context", (req, res) => {
   res.json(sharedContext);
 });
@@ -319,6 +384,15 @@ app.get("/secrets/:name", requireAuth, async (req, res) => {
       : workspaceCfg;
     const cfg = JSON.parse(fs.readFileSync(cfgPathLocal, "utf8"));
     const name = req.params.name;
+    // audit trail: who read what, and why (values are never logged)
+    logger.info("secret read", {
+      name,
+      reason: req.get("X-Central-Mcp-Reason") || null,
+      userAgent: req.get("User-Agent") || null,
+      clientTags: req.get("X-Central-Mcp-Client-Tags") || null,
+      client: req.client ? req.client.name : null,
+      ip: req.ip,
+    });
     // support cfg.secrets.{name} or top-level key
     if (
       cfg.secrets &&
@@ -0,0 +1,49 @@
+const { parseRequestedScope, scopeAllows } = require('../middleware/auth');
+
+describe('auth middleware helpers', () => {
+  describe('parseRequestedScope', () => {
+    test('should leave the token unscoped when no scope is asked for', () => {
+      expect(parseRequestedScope(undefined)).toEqual({ scope: undefined });
+      expect(parseRequestedScope('')).toEqual({ scope: undefined });
+      expect(parseRequestedScope('  ')).toEqual({ scope: undefined });
+    });
+
+    test('should normalize known scopes', () => {
+      expect(parseRequestedScope('read')).toEqual({ scope: 'read' });
+      expect(parseRequestedScope(' read  read write ')).toEqual({ scope: 'read write' });
+    });
+
+    test('should reject unknown scopes and non-strings', () => {
+      expect(parseRequestedScope('read admin').error).toMatch(/admin/);
+      expect(parseRequestedScope(['read']).error).toBeDefined();
+    });
+  });
+
+  describe('scopeAllows', () => {
+    const get = { method: 'GET', path: '/secrets/db' };
+    const post = { method: 'POST', path: '/mcp/servers' };
+    const del = { method: 'DELETE', path: '/mcp/servers/abc' };
+    const introspect = { method: 'POST', path: '/token/introspect' };
+
+    test('should let unscoped tokens do anything', () => {
+      const payload = { iss: 'central-mcp' };
+      [get, post, del, introspect].forEach((req) => {
+        expect(scopeAllows(payload, req)).toBe(true);
+      });
+    });
+
+    test('should limit read tokens to reads', () => {
+      const payload = { iss: 'central-mcp', scope: 'read' };
+      expect(scopeAllows(payload, get)).toBe(true);
+      expect(scopeAllows(payload, introspect)).toBe(true);
+      expect(scopeAllows(payload, post)).toBe(false);
+      expect(scopeAllows(payload, del)).toBe(false);
+    });
+
+    test('should let write tokens change state', () => {
+      const payload = { iss: 'central-mcp', scope: 'write' };
+      expect(scopeAllows(payload, post)).toBe(true);
+      expect(scopeAllows(payload, get)).toBe(true);
+    });
+  });
+});
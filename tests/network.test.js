@@ -0,0 +1,52 @@
+const {
+  DEFAULT_CORS_HEADERS,
+  parseList,
+  parseTrustedProxies,
+  corsOptions
+} = require('../middleware/network');
+
+describe('network middleware helpers', () => {
+  describe('parseList', () => {
+    test('should split and trim comma-separated values', () => {
+      expect(parseList(undefined)).toEqual([]);
+      expect(parseList('')).toEqual([]);
+      expect(parseList(' a, b ,,c ')).toEqual(['a', 'b', 'c']);
+    });
+  });
+
+  describe('parseTrustedProxies', () => {
+    test('should accept addresses, CIDRs and Express keywords', () => {
+      expect(parseTrustedProxies('10.0.0.0/8, 192.168.1.5,fd00::/8,loopback'))
+        .toEqual(['10.0.0.0/8', '192.168.1.5', 'fd00::/8', 'loopback']);
+    });
+
+    test('should reject malformed entries', () => {
+      ['10.0.0.0/33', 'lb.internal', '10.0.0.1/8/1', '::1/129', '10.0.0.0/x'].forEach((entry) => {
+        expect(() => parseTrustedProxies(entry)).toThrow(entry);
+      });
+    });
+  });
+
+  describe('corsOptions', () => {
+    test('should disable CORS when no origins are configured', () => {
+      expect(corsOptions({})).toEqual({
+        origin: false,
+        allowedHeaders: DEFAULT_CORS_HEADERS,
+        credentials: false
+      });
+    });
+
+    test('should allow only the configured origins and headers', () => {
+      const opts = corsOptions({
+        CENTRAL_MCP_CORS_ORIGINS: 'https://dash.example.com, https://tools.example.com',
+        CENTRAL_MCP_CORS_HEADERS: 'Content-Type,Authorization'
+      });
+      expect(opts.origin).toEqual(['https://dash.example.com', 'https://tools.example.com']);
+      expect(opts.allowedHeaders).toEqual(['Content-Type', 'Authorization']);
+    });
+
+    test('should allow any origin only when asked for explicitly', () => {
+      expect(corsOptions({ CENTRAL_MCP_CORS_ORIGINS: '*' }).origin).toBe('*');
+    });
+  });
+});